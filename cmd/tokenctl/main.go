@@ -0,0 +1,369 @@
+// Command tokenctl decodes, verifies and mints AuthTokens locally, so that
+// tokens never need to be pasted into third-party websites.
+//
+//	tokenctl decode [token]
+//	tokenctl verify (-key public.pem | -jwks jwks.json) [-aud a,b] [-iss issuer] [-leeway 30s] [token]
+//	tokenctl mint -key private.pem -role role -sub subject [-ttl 1h] [...]
+//
+// When the token argument is omitted (or is "-") it is read from stdin,
+// keeping it out of shell history.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+
+	"github.com/cosmotek/api-commons/token"
+)
+
+const usage = `usage: tokenctl <command> [flags] [token]
+
+commands:
+  decode   print the header and claims of a token without verifying it
+  verify   verify a token against a PEM public key or JWKS file/url
+  mint     sign a test token using a local PEM private key
+
+run 'tokenctl <command> -h' for the flags of each command
+`
+
+// timeClaims are the claims printed as human-readable times.
+var timeClaims = map[string]bool{
+	"iat": true,
+	"nbf": true,
+	"exp": true,
+}
+
+// verifier is implemented by both token.Key and token.KeyRing.
+type verifier interface {
+	token.Verifier
+	SetValidationConfig(conf token.ValidationConfig)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "decode":
+		err = decodeCmd(os.Args[2:])
+	case "verify":
+		err = verifyCmd(os.Args[2:])
+	case "mint":
+		err = mintCmd(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// decodeCmd prints the header and claims of a token without verifying it.
+func decodeCmd(args []string) error {
+	flags := flag.NewFlagSet("decode", flag.ExitOnError)
+	flags.Parse(args)
+
+	tokenStr, err := readToken(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("WARNING: signature NOT verified")
+	return printToken(os.Stdout, tokenStr)
+}
+
+// verifyCmd verifies a token against a PEM public key or JWKS, printing
+// its claims followed by the exact validation failure (if any).
+func verifyCmd(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	keyFile := flags.String("key", "", "PEM encoded RSA, EC or Ed25519 public key file")
+	jwksFile := flags.String("jwks", "", "JWKS file or http(s) url")
+	audiences := flags.String("aud", "", "comma separated list of accepted audiences")
+	issuer := flags.String("iss", "", "expected issuer")
+	leeway := flags.Duration("leeway", 0, "clock skew tolerated when checking time claims")
+	flags.Parse(args)
+
+	if (*keyFile == "") == (*jwksFile == "") {
+		return errors.New("exactly one of -key or -jwks is required")
+	}
+
+	tokenStr, err := readToken(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	v, err := loadVerifier(*keyFile, *jwksFile)
+	if err != nil {
+		return err
+	}
+
+	conf := token.ValidationConfig{Leeway: *leeway, Issuer: *issuer}
+	if *audiences != "" {
+		conf.Audiences = strings.Split(*audiences, ",")
+	}
+	v.SetValidationConfig(conf)
+
+	err = printToken(os.Stdout, tokenStr)
+	if err != nil {
+		return err
+	}
+
+	_, err = v.Verify(tokenStr)
+	if err != nil {
+		return describeFailure(tokenStr, err)
+	}
+
+	fmt.Println("\nOK: token is valid")
+	return nil
+}
+
+// mintCmd signs a test token using a local private key, printing the
+// token string.
+func mintCmd(args []string) error {
+	flags := flag.NewFlagSet("mint", flag.ExitOnError)
+	keyFile := flags.String("key", "", "PEM encoded RSA, EC or Ed25519 private key file")
+	kid := flags.String("kid", "", "key id (kid header)")
+	role := flags.String("role", "", "token role")
+	subject := flags.String("sub", "", "token subject")
+	subjectType := flags.String("subtype", "", "token subject type (email, phone_number, api_key)")
+	audience := flags.String("aud", "", "token audience")
+	issuer := flags.String("iss", "", "token issuer")
+	orgID := flags.String("org", "", "token organization id")
+	tokenVersion := flags.Int("tver", 1, "token version")
+	ttl := flags.Duration("ttl", time.Hour, "time until the token expires")
+	claimsJSON := flags.String("claims", "", "custom claims as a JSON object")
+	flags.Parse(args)
+
+	if *keyFile == "" || *role == "" || *subject == "" {
+		return errors.New("-key, -role and -sub are required")
+	}
+
+	subType, err := parseSubjectType(*subjectType)
+	if err != nil {
+		return err
+	}
+
+	privateKey, err := token.ParsePrivateKey(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	key, err := token.NewSigningKey(*kid, privateKey)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	authToken := token.AuthToken{
+		ID:           uuid.New().String(),
+		TokenVersion: *tokenVersion,
+		Role:         token.Role(*role),
+		Audience:     *audience,
+		Issuer:       *issuer,
+		Subject:      *subject,
+		SubjectType:  subType,
+		OrgID:        *orgID,
+		IssuedAt:     now,
+		NotBefore:    now,
+		ExpiresAt:    now.Add(*ttl),
+	}
+
+	if *claimsJSON != "" {
+		err = json.Unmarshal([]byte(*claimsJSON), &authToken.Claims)
+		if err != nil {
+			return fmt.Errorf("failed to parse -claims: %v", err)
+		}
+	}
+
+	tokenStr, err := key.Sign(authToken)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(tokenStr)
+	return nil
+}
+
+// parseSubjectType returns the token.SubjectType named by value, accepting
+// either the claim value (e.g. "phone_number") or the Go constant name
+// (e.g. "PhoneNumber"). An empty value omits the claim.
+func parseSubjectType(value string) (token.SubjectType, error) {
+	subjectTypes := map[string]token.SubjectType{
+		"Email":       token.Email,
+		"PhoneNumber": token.PhoneNumber,
+		"APIKey":      token.APIKey,
+	}
+
+	if subjectType, ok := subjectTypes[value]; ok {
+		return subjectType, nil
+	}
+
+	for _, subjectType := range subjectTypes {
+		if value == string(subjectType) {
+			return subjectType, nil
+		}
+	}
+
+	if value != "" {
+		return "", fmt.Errorf("unknown -subtype '%s', expected email, phone_number or api_key", value)
+	}
+
+	return "", nil
+}
+
+// loadVerifier loads a verification key from a PEM file, or a key ring
+// from a JWKS file or url.
+func loadVerifier(keyFile, jwksFile string) (verifier, error) {
+	if keyFile != "" {
+		publicKey, err := token.ParsePublicKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return token.NewVerificationKey("", publicKey)
+	}
+
+	if strings.HasPrefix(jwksFile, "http://") || strings.HasPrefix(jwksFile, "https://") {
+		return token.FetchJWKS(jwksFile)
+	}
+
+	data, err := ioutil.ReadFile(jwksFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return token.ParseJWKS(data)
+}
+
+// describeFailure expands a verification error with the claim values
+// which caused it, where they are known.
+func describeFailure(tokenStr string, err error) error {
+	authToken, decodeErr := token.DecodeUnverified(tokenStr)
+	if decodeErr != nil {
+		return fmt.Errorf("INVALID: %v", err)
+	}
+
+	switch err {
+	case token.ErrTokenExpired:
+		return fmt.Errorf("INVALID: token expired at %s (%s ago)",
+			authToken.ExpiresAt.Format(time.RFC3339), time.Since(authToken.ExpiresAt).Round(time.Second))
+	case token.ErrTokenOutdated:
+		return fmt.Errorf("INVALID: token version (tver) %d is outdated", authToken.TokenVersion)
+	case token.ErrInvalidAudience:
+		return fmt.Errorf("INVALID: token audience '%s' not accepted", authToken.Audience)
+	case token.ErrInvalidIssuer:
+		return fmt.Errorf("INVALID: token issuer '%s' not accepted", authToken.Issuer)
+	default:
+		return fmt.Errorf("INVALID: %v", err)
+	}
+}
+
+// printToken prints the header and claims of a token, with time
+// claims rendered as human-readable times.
+func printToken(w io.Writer, tokenStr string) error {
+	parsed, _, err := new(jwt.Parser).ParseUnverified(tokenStr, jwt.MapClaims{})
+	if err != nil {
+		return fmt.Errorf("failed to decode, token malformed: %v", err)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "header:")
+	printMap(tw, parsed.Header)
+
+	fmt.Fprintln(tw, "claims:")
+	printMap(tw, parsed.Claims.(jwt.MapClaims))
+
+	return tw.Flush()
+}
+
+// printMap prints the entries of m sorted by key.
+func printMap(w io.Writer, m map[string]interface{}) {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %s\t%s\n", key, formatClaim(key, m[key]))
+	}
+}
+
+// formatClaim formats a claim value for display.
+func formatClaim(key string, value interface{}) string {
+	if seconds, ok := value.(float64); ok && timeClaims[key] {
+		t := time.Unix(int64(seconds), 0).UTC()
+		return fmt.Sprintf("%d (%s, %s)", int64(seconds), t.Format(time.RFC3339), relativeTime(t))
+	}
+
+	if str, ok := value.(string); ok {
+		if t, err := time.Parse(time.RFC3339, str); err == nil && timeClaims[key] {
+			return fmt.Sprintf("%s (legacy RFC3339, %s)", str, relativeTime(t))
+		}
+
+		return str
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+
+	return string(data)
+}
+
+// relativeTime describes t relative to now, e.g. "in 59m0s" or "3h0m0s ago".
+func relativeTime(t time.Time) string {
+	diff := time.Until(t).Round(time.Second)
+	if diff == 0 {
+		return "now"
+	}
+
+	if diff < 0 {
+		return fmt.Sprintf("%s ago", -diff)
+	}
+
+	return fmt.Sprintf("in %s", diff)
+}
+
+// readToken returns the token argument, reading it from stdin when
+// it is empty or "-".
+func readToken(arg string) (string, error) {
+	if arg != "" && arg != "-" {
+		return strings.TrimSpace(arg), nil
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", errors.New("no token provided")
+	}
+
+	return line, nil
+}
@@ -33,7 +33,42 @@ type MigrationStatus struct {
 	Latest  uint64
 }
 
+// add accumulates the migration counts of another status.
+func (s *MigrationStatus) add(other MigrationStatus) {
+	s.Applied += other.Applied
+	s.Failed += other.Failed
+	s.Skipped += other.Skipped
+}
+
+// SyncMigrations applies any pending namespaced migrations (Config.Migrations),
+// followed by any pending migrations in the migration directory. Library
+// migrations run first so that application migrations may reference their
+// tables. The returned status counts migrations from every source, while
+// Latest is the application migration version.
 func (d *Database) SyncMigrations() (MigrationStatus, error) {
+	totalStatus := MigrationStatus{}
+	for _, source := range d.migrationSources {
+		status, err := d.SyncNamespaceMigrations(source)
+		totalStatus.add(status)
+		if err != nil {
+			return totalStatus, err
+		}
+	}
+
+	if d.migrationDir == "" {
+		currentMig, err := d.GetCurrentMigration()
+		totalStatus.Latest = currentMig.Version
+		return totalStatus, err
+	}
+
+	status, err := d.syncDirMigrations()
+	totalStatus.add(status)
+	totalStatus.Latest = status.Latest
+	return totalStatus, err
+}
+
+// syncDirMigrations applies any pending migrations in the migration directory.
+func (d *Database) syncDirMigrations() (MigrationStatus, error) {
 	currentMig, err := d.GetCurrentMigration()
 	if err != nil {
 		return MigrationStatus{}, err
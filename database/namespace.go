@@ -0,0 +1,183 @@
+package database
+
+import (
+	"context"
+	"crypto/md5"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// MigrationSource is a set of numbered migration files (1.sql, 2.sql, ...)
+// shipped by a library package, typically embedded using go:embed. The version
+// of each source is tracked under its Namespace in the `db_namespace_versions`
+// table, independently of the application's `db_version`, so library and
+// application migration versions never collide.
+type MigrationSource struct {
+	Namespace string
+	FS        fs.FS
+}
+
+// NewEmbeddedMigrationSource returns the MigrationSource of the migration files
+// embedded under dir of fsys. It panics if dir does not exist, as embedded
+// directories are known at compile time.
+func NewEmbeddedMigrationSource(namespace string, fsys embed.FS, dir string) MigrationSource {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+
+	return MigrationSource{
+		Namespace: namespace,
+		FS:        sub,
+	}
+}
+
+// GetNamespaceMigration returns the current migration of a namespace,
+// creating the tracking record (at version 0) if it does not exist.
+func (d *Database) GetNamespaceMigration(namespace string) (Migration, error) {
+	migration := Migration{}
+	err := d.Update(context.Background(), func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(`
+			INSERT INTO db_namespace_versions
+			(namespace, version, hash, file, last_run, complete) VALUES
+			($1, 0, '', '', NOW(), true)
+			ON CONFLICT (namespace) DO NOTHING;
+		`, namespace)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Get(&migration, `
+			SELECT version, hash, file, last_run, complete FROM db_namespace_versions
+			WHERE namespace = $1 LIMIT 1
+		`, namespace)
+		if err != nil {
+			return fmt.Errorf("failed to fetch migration status of namespace %s: %s", namespace, err.Error())
+		}
+
+		return nil
+	})
+
+	return migration, err
+}
+
+// SyncNamespaceMigrations applies any pending migrations of the provided source.
+func (d *Database) SyncNamespaceMigrations(source MigrationSource) (MigrationStatus, error) {
+	if source.Namespace == "" || source.FS == nil {
+		return MigrationStatus{}, errors.New("migration source requires a namespace and filesystem")
+	}
+
+	currentMigration, err := d.GetNamespaceMigration(source.Namespace)
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+
+	if !currentMigration.Complete {
+		return MigrationStatus{}, fmt.Errorf(
+			"migration %d in file %s of namespace %s appears to have failed, please rectify manually",
+			currentMigration.Version, currentMigration.File, source.Namespace,
+		)
+	}
+
+	migrations := make([]Migration, 0)
+	err = fs.WalkDir(source.FS, ".", func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() || path.Ext(filePath) != ".sql" {
+			return nil
+		}
+
+		version, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), ".sql"), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		bytes, err := fs.ReadFile(source.FS, filePath)
+		if err != nil {
+			return err
+		}
+
+		migrations = append(migrations, Migration{
+			File:     filePath,
+			Hash:     fmt.Sprintf("%x", md5.Sum(bytes)),
+			Version:  uint64(version),
+			Complete: uint64(version) <= currentMigration.Version,
+		})
+		return nil
+	})
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+
+	sort.Sort(MigrationSet(migrations))
+	migrationStatus := MigrationStatus{
+		Latest: currentMigration.Version,
+	}
+
+	for _, migration := range migrations {
+		if migration.Complete {
+			migrationStatus.Skipped += 1
+			continue
+		}
+
+		err := d.runNamespaceMigration(source, migration)
+		if err != nil {
+			migrationStatus.Failed += 1
+
+			return migrationStatus, err
+		}
+
+		migrationStatus.Applied += 1
+		migrationStatus.Latest = migration.Version
+	}
+
+	return migrationStatus, nil
+}
+
+// runNamespaceMigration executes a single migration of source, marking the
+// namespace as incomplete while it runs.
+func (d *Database) runNamespaceMigration(source MigrationSource, migration Migration) error {
+	err := d.Update(context.Background(), func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(
+			"UPDATE db_namespace_versions SET version = $1, hash = $2, file = $3, last_run = $4, complete = $5 WHERE namespace = $6",
+			migration.Version, migration.Hash, migration.File, time.Now(), false, source.Namespace,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to open migration step: %s", err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	bytes, err := fs.ReadFile(source.FS, migration.File)
+	if err != nil {
+		return err
+	}
+
+	err = d.ExecSQL(string(bytes))
+	if err != nil {
+		return fmt.Errorf("failed to run migration %s of namespace %s: %s", migration.File, source.Namespace, err.Error())
+	}
+
+	return d.Update(context.Background(), func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(
+			"UPDATE db_namespace_versions SET complete = $1 WHERE namespace = $2 AND version = $3",
+			true, source.Namespace, migration.Version,
+		)
+		return err
+	})
+}
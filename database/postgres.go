@@ -5,7 +5,6 @@ import (
 	"database/sql"
 	"fmt"
 	"io/ioutil"
-	"strings"
 
 	"github.com/doug-martin/goqu/v9"
 	"github.com/jmoiron/sqlx"
@@ -17,6 +16,11 @@ import (
 type Config struct {
 	User, Password, Host, Port, DatabaseName, MigrationDir string
 	SSLDisabled                                            bool
+
+	// Migrations are the namespaced migrations shipped by library packages
+	// (such as token.Migrations), applied by SyncMigrations before the
+	// migrations found in MigrationDir.
+	Migrations []MigrationSource
 }
 
 type Database struct {
@@ -24,29 +28,36 @@ type Database struct {
 	migrationDir string
 	goqu.DialectWrapper
 	*goqu.Database
+	migrationSources []MigrationSource
 }
 
 // DB is an alias to Database (less to type out).
 type DB = Database
 
-// Dial connects to a postgres database using the provided configuration,
-// and creates/updates the migration table `db_version` with the current version.
-func Dial(conf Config) (*Database, error) {
+// ConnectionString returns the postgres connection string described by the
+// configuration, for use with sql.Open or pq.NewListener.
+func (c Config) ConnectionString() string {
 	sslMode := "require"
-	if conf.SSLDisabled {
+	if c.SSLDisabled {
 		sslMode = "disable"
 	}
 
-	url := fmt.Sprintf(
+	return fmt.Sprintf(
 		"user=%s password=%s host=%s port=%s dbname=%s sslmode=%s",
-		conf.User,
-		conf.Password,
-		conf.Host,
-		conf.Port,
-		conf.DatabaseName,
+		c.User,
+		c.Password,
+		c.Host,
+		c.Port,
+		c.DatabaseName,
 		sslMode,
 	)
-	db, err := sql.Open("postgres", url)
+}
+
+// Dial connects to a postgres database using the provided configuration,
+// and creates/updates the migration table `db_version` with the current version,
+// and the `db_namespace_versions` table used to track namespaced migrations.
+func Dial(conf Config) (*Database, error) {
+	db, err := sql.Open("postgres", conf.ConnectionString())
 	if err != nil {
 		return nil, err
 	}
@@ -65,11 +76,26 @@ func Dial(conf Config) (*Database, error) {
 		return nil, err
 	}
 
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS db_namespace_versions (
+			namespace VARCHAR(256) PRIMARY KEY,
+			version bigint,
+			hash VARCHAR(256),
+			file VARCHAR(256),
+			last_run TIMESTAMPTZ,
+			complete BOOLEAN
+		);
+	`)
+	if err != nil {
+		return nil, err
+	}
+
 	d := &Database{
 		sqlx.NewDb(db, "postgres"),
 		conf.MigrationDir,
 		goqu.Dialect("postgres"),
 		goqu.New("postgres", db),
+		conf.Migrations,
 	}
 	_, err = d.GetCurrentMigration()
 	if err != nil {
@@ -128,23 +154,26 @@ func (d *Database) Update(ctx context.Context, callback func(*sqlx.Tx) error) er
 	return d.exec(ctx, callback, false)
 }
 
-// ExecFile parses the SQL blocks within a file and executes them independently
-// from first to last.
+// ExecFile executes the SQL statements within a file, see ExecSQL.
 func (d *Database) ExecFile(filepath string) error {
 	bytes, err := ioutil.ReadFile(filepath)
 	if err != nil {
 		return err
 	}
 
-	// split on the semicolon delimiter
-	blocks := strings.Split(string(bytes), ";")
+	return d.ExecSQL(string(bytes))
+}
 
+// ExecSQL executes the SQL statements within a string from first to last,
+// within a single transaction. The string is sent to the server as a single
+// query (which lib/pq supports when no arguments are provided), leaving
+// statement parsing to Postgres so that semicolons within function bodies,
+// DO blocks and string literals are handled correctly.
+func (d *Database) ExecSQL(sqlStr string) error {
 	return d.Update(context.Background(), func(tx *sqlx.Tx) error {
-		for i, block := range blocks {
-			_, err := tx.Exec(block)
-			if err != nil {
-				return fmt.Errorf("failed to execute block %d of sql file: %s", i, err.Error())
-			}
+		_, err := tx.Exec(sqlStr)
+		if err != nil {
+			return fmt.Errorf("failed to execute sql: %s", err.Error())
 		}
 
 		return nil
@@ -1,6 +1,6 @@
 module github.com/cosmotek/api-commons
 
-go 1.14
+go 1.16
 
 require (
 	cloud.google.com/go/firestore v1.3.0 // indirect
@@ -8,6 +8,7 @@ require (
 	github.com/cosmotek/mailgo v0.0.0-20191210191450-42bb876cc816
 	github.com/cosmotek/nexgo v0.0.0-20191207044309-47dc8fe3fdb1
 	github.com/doug-martin/goqu/v9 v9.13.0
+	github.com/fxamacker/cbor/v2 v2.4.0
 	github.com/golang-jwt/jwt/v4 v4.0.0
 	github.com/google/go-cmp v0.5.2
 	github.com/google/uuid v1.2.0
@@ -18,11 +19,13 @@ require (
 	github.com/minio/minio-go/v6 v6.0.57
 	github.com/mitchellh/mapstructure v1.3.3
 	github.com/rs/zerolog v1.20.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/ttacon/builder v0.0.0-20170518171403-c099f663e1c2 // indirect
 	github.com/ttacon/libphonenumber v1.2.1
 	goji.io v2.0.2+incompatible
 	golang.org/x/net v0.0.0-20201202161906-c7110b5ffcbb // indirect
 	golang.org/x/sys v0.0.0-20201119102817-f84b799fce68 // indirect
 	google.golang.org/api v0.35.0
+	google.golang.org/grpc v1.31.1
 	googlemaps.github.io/maps v1.3.1
 )
@@ -0,0 +1,332 @@
+package token
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+
+	"github.com/cosmotek/api-commons/database"
+)
+
+// DefaultAPIKeyPrefix is the prefix used for API keys created
+// without an explicit prefix.
+const DefaultAPIKeyPrefix = "ak"
+
+const (
+	apiKeyIDLength     = 16
+	apiKeySecretLength = 40
+	apiKeyAlphabet     = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+var (
+	// ErrAPIKeyInvalid is returned when an API key is malformed or does not exist.
+	ErrAPIKeyInvalid = errors.New("user error: failed to authenticate, api key invalid")
+
+	// ErrAPIKeyRevoked is returned when an API key has been revoked.
+	ErrAPIKeyRevoked = errors.New("user error: failed to authenticate, api key has been revoked")
+
+	// ErrAPIKeyExpired is returned when an API key has expired.
+	ErrAPIKeyExpired = errors.New("user error: failed to authenticate, api key has expired")
+)
+
+// APIKeyRecord is an API key record, used to authenticate ServiceUser actors.
+// Only a hash of the key is stored, the key itself is returned once by
+// CreateAPIKey and cannot be recovered.
+type APIKeyRecord struct {
+	ID         string     `json:"id" db:"id"`
+	Prefix     string     `json:"prefix" db:"prefix"`
+	KeyHash    string     `json:"-" db:"key_hash"`
+	Name       string     `json:"name" db:"name"`
+	Owner      string     `json:"owner" db:"owner"`
+	Role       Role       `json:"role" db:"role"`
+	OrgID      string     `json:"orgId,omitempty" db:"org_id"`
+	CreatedAt  time.Time  `json:"createdAt" db:"created_at"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty" db:"expires_at"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty" db:"last_used_at"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty" db:"revoked_at"`
+}
+
+// CreateAPIKey generates an API key described by input (Name, Owner, Role,
+// OrgID, ExpiresAt and optionally Prefix), storing only its hash. The
+// record and the plaintext key are returned to the caller (ordered record,
+// key, error), keys are formatted as <prefix>_<id>_<secret>.
+func CreateAPIKey(db *database.DB, input APIKeyRecord) (APIKeyRecord, string, error) {
+	return CreateAPIKeyContext(context.Background(), db, input)
+}
+
+// CreateAPIKeyContext is CreateAPIKey using the provided context.
+func CreateAPIKeyContext(ctx context.Context, db *database.DB, input APIKeyRecord) (APIKeyRecord, string, error) {
+	queryStr := `
+	INSERT INTO api_keys (
+		id,
+		prefix,
+		key_hash,
+		name,
+		owner,
+		role,
+		org_id,
+		created_at,
+		expires_at
+	) VALUES (
+		:id,
+		:prefix,
+		:key_hash,
+		:name,
+		:owner,
+		:role,
+		:org_id,
+		:created_at,
+		:expires_at
+	);
+	`
+
+	if input.Prefix == "" {
+		input.Prefix = DefaultAPIKeyPrefix
+	}
+
+	if input.Role == "" {
+		input.Role = ServiceUser
+	}
+
+	id, err := randomString(apiKeyIDLength)
+	if err != nil {
+		return APIKeyRecord{}, "", err
+	}
+
+	secret, err := randomString(apiKeySecretLength)
+	if err != nil {
+		return APIKeyRecord{}, "", err
+	}
+
+	key := input.Prefix + "_" + id + "_" + secret
+	input.ID = id
+	input.KeyHash = hashAPIKey(key)
+	input.CreatedAt = time.Now().UTC()
+	input.LastUsedAt = nil
+	input.RevokedAt = nil
+
+	err = db.Update(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.NamedExec(queryStr, input)
+		return err
+	})
+	if err != nil {
+		return APIKeyRecord{}, "", err
+	}
+
+	return input, key, nil
+}
+
+// VerifyAPIKey looks up the record for key, comparing its hash in constant
+// time, and records the time the key was last used. An error is returned if
+// the key is invalid, revoked or expired.
+func VerifyAPIKey(db *database.DB, key string) (APIKeyRecord, error) {
+	return VerifyAPIKeyContext(context.Background(), db, key)
+}
+
+// VerifyAPIKeyContext is VerifyAPIKey using the provided context.
+func VerifyAPIKeyContext(ctx context.Context, db *database.DB, key string) (APIKeyRecord, error) {
+	var apiKey APIKeyRecord
+	err := db.Update(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		apiKey, err = VerifyAPIKeyTx(tx, key)
+		return err
+	})
+	if err != nil {
+		return APIKeyRecord{}, err
+	}
+
+	return apiKey, nil
+}
+
+// VerifyAPIKeyTx is VerifyAPIKey using an existing transaction. The api_keys
+// record is locked until the transaction ends, so that a concurrent
+// RevokeAPIKey waits for it.
+func VerifyAPIKeyTx(tx *sqlx.Tx, key string) (APIKeyRecord, error) {
+	id, ok := parseAPIKeyID(key)
+	if !ok {
+		return APIKeyRecord{}, ErrAPIKeyInvalid
+	}
+
+	apiKey := APIKeyRecord{}
+	err := tx.Get(&apiKey, `SELECT * FROM api_keys k WHERE k.id = $1 LIMIT 1 FOR UPDATE`, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return APIKeyRecord{}, ErrAPIKeyInvalid
+		}
+
+		return APIKeyRecord{}, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(key)), []byte(apiKey.KeyHash)) != 1 {
+		return APIKeyRecord{}, ErrAPIKeyInvalid
+	}
+
+	now := time.Now().UTC()
+	if apiKey.RevokedAt != nil {
+		return APIKeyRecord{}, ErrAPIKeyRevoked
+	}
+
+	if apiKey.ExpiresAt != nil && apiKey.ExpiresAt.Before(now) {
+		return APIKeyRecord{}, ErrAPIKeyExpired
+	}
+
+	apiKey.LastUsedAt = &now
+	_, err = tx.Exec(`UPDATE api_keys SET last_used_at = $2 WHERE id = $1`, id, now)
+	if err != nil {
+		return APIKeyRecord{}, err
+	}
+
+	return apiKey, nil
+}
+
+// ListAPIKeys returns every API key (including revoked keys) belonging
+// to owner, newest first.
+func ListAPIKeys(db *database.DB, owner string) ([]APIKeyRecord, error) {
+	return ListAPIKeysContext(context.Background(), db, owner)
+}
+
+// ListAPIKeysContext is ListAPIKeys using the provided context.
+func ListAPIKeysContext(ctx context.Context, db *database.DB, owner string) ([]APIKeyRecord, error) {
+	apiKeys := []APIKeyRecord{}
+	err := db.View(ctx, func(tx *sqlx.Tx) error {
+		return tx.Select(&apiKeys, `SELECT * FROM api_keys k WHERE k.owner = $1 ORDER BY k.created_at DESC`, owner)
+	})
+
+	return apiKeys, err
+}
+
+// RevokeAPIKey revokes the API key identified by id, and deactivates any
+// tokens which were issued in exchange for it.
+func RevokeAPIKey(db *database.DB, id string) error {
+	return RevokeAPIKeyContext(context.Background(), db, id)
+}
+
+// RevokeAPIKeyContext is RevokeAPIKey using the provided context.
+func RevokeAPIKeyContext(ctx context.Context, db *database.DB, id string) error {
+	return db.Update(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(`UPDATE api_keys SET revoked_at = $2 WHERE id = $1 AND revoked_at IS NULL`, id, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE jwt_tokens SET deactivated = TRUE WHERE subject = $1 AND subject_type = $2`, id, APIKey)
+		if err != nil {
+			return err
+		}
+
+		return notifyRevocation(tx, "sub:"+id)
+	})
+}
+
+// ExchangeAPIKey verifies key and issues a short-lived AuthToken for it,
+// signed using signer and recorded in jwt_tokens (ordered token, signed
+// token string, error). The token subject is the API key ID. The key is
+// verified and the token recorded in a single transaction, so a token is
+// never issued for a key revoked in the meantime.
+func ExchangeAPIKey(db *database.DB, signer Signer, key, audience string, ttl time.Duration) (AuthToken, string, error) {
+	return ExchangeAPIKeyContext(context.Background(), db, signer, key, audience, ttl)
+}
+
+// ExchangeAPIKeyContext is ExchangeAPIKey using the provided context.
+func ExchangeAPIKeyContext(ctx context.Context, db *database.DB, signer Signer, key, audience string, ttl time.Duration) (AuthToken, string, error) {
+	var authToken AuthToken
+	var tokenStr string
+	err := db.Update(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		authToken, tokenStr, err = ExchangeAPIKeyTx(tx, signer, key, audience, ttl)
+		return err
+	})
+	if err != nil {
+		return AuthToken{}, "", err
+	}
+
+	return authToken, tokenStr, nil
+}
+
+// ExchangeAPIKeyTx is ExchangeAPIKey using an existing transaction.
+func ExchangeAPIKeyTx(tx *sqlx.Tx, signer Signer, key, audience string, ttl time.Duration) (AuthToken, string, error) {
+	apiKey, err := VerifyAPIKeyTx(tx, key)
+	if err != nil {
+		return AuthToken{}, "", err
+	}
+
+	version, err := CurrentTokenVersionTx(tx, apiKey.ID)
+	if err != nil {
+		return AuthToken{}, "", err
+	}
+
+	now := time.Now().UTC()
+	authToken := AuthToken{
+		ID:           uuid.New().String(),
+		TokenVersion: version,
+		Role:         apiKey.Role,
+		Audience:     audience,
+		Subject:      apiKey.ID,
+		SubjectType:  APIKey,
+		OrgID:        apiKey.OrgID,
+		IssuedAt:     now,
+		NotBefore:    now,
+		ExpiresAt:    now.Add(ttl),
+	}
+
+	tokenStr, err := signer.Sign(authToken)
+	if err != nil {
+		return AuthToken{}, "", err
+	}
+
+	err = RecordTokenCreateTx(tx, authToken)
+	if err != nil {
+		return AuthToken{}, "", err
+	}
+
+	return authToken, tokenStr, nil
+}
+
+// parseAPIKeyID extracts the id segment of a <prefix>_<id>_<secret> key.
+func parseAPIKeyID(key string) (string, bool) {
+	secretIndex := strings.LastIndex(key, "_")
+	if secretIndex < 0 || len(key)-secretIndex-1 != apiKeySecretLength {
+		return "", false
+	}
+
+	idIndex := strings.LastIndex(key[:secretIndex], "_")
+	if idIndex < 0 || secretIndex-idIndex-1 != apiKeyIDLength {
+		return "", false
+	}
+
+	return key[idIndex+1 : secretIndex], true
+}
+
+// hashAPIKey returns the hex encoded sha256 hash of an API key. Keys contain
+// over 230 bits of entropy, so a fast hash is sufficient.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomString generates a random string of the provided length
+// from apiKeyAlphabet using crypto/rand.
+func randomString(length int) (string, error) {
+	max := big.NewInt(int64(len(apiKeyAlphabet)))
+	output := make([]byte, length)
+	for i := range output {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+
+		output[i] = apiKeyAlphabet[n.Int64()]
+	}
+
+	return string(output), nil
+}
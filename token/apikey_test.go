@@ -0,0 +1,122 @@
+package token
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAPIKeyID(t *testing.T) {
+	id := strings.Repeat("i", apiKeyIDLength)
+	secret := strings.Repeat("s", apiKeySecretLength)
+
+	scenarios := map[string]struct {
+		Key string
+		ID  string
+		OK  bool
+	}{
+		"should parse a valid key":                 {Key: "ak_" + id + "_" + secret, ID: id, OK: true},
+		"should parse a prefix containing '_'":     {Key: "my_app_" + id + "_" + secret, ID: id, OK: true},
+		"should parse an empty prefix":             {Key: "_" + id + "_" + secret, ID: id, OK: true},
+		"should reject a short secret":             {Key: "ak_" + id + "_" + secret[1:]},
+		"should reject a long secret":              {Key: "ak_" + id + "_" + secret + "s"},
+		"should reject a short id":                 {Key: "ak_" + id[1:] + "_" + secret},
+		"should reject a long id":                  {Key: "ak_" + id + "i_" + secret},
+		"should reject a key without underscores":  {Key: "ak" + id + secret},
+		"should reject a key without a prefix '_'": {Key: id + "_" + secret},
+		"should reject an empty key":               {Key: ""},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			id, ok := parseAPIKeyID(scene.Key)
+			if ok != scene.OK || id != scene.ID {
+				t.Fatalf("expected ('%s', %v) but got ('%s', %v)", scene.ID, scene.OK, id, ok)
+			}
+		})
+	}
+}
+
+func TestRandomString(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		str, err := randomString(apiKeySecretLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(str) != apiKeySecretLength {
+			t.Fatalf("expected length %d, got %d", apiKeySecretLength, len(str))
+		}
+
+		if strings.Trim(str, apiKeyAlphabet) != "" {
+			t.Fatalf("expected only characters of apiKeyAlphabet, got '%s'", str)
+		}
+
+		if seen[str] {
+			t.Fatalf("expected unique strings, got '%s' twice", str)
+		}
+
+		seen[str] = true
+	}
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	db := testDatabase(t)
+
+	signer, err := NewSigningKey("kid", newTestRSAKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, key, err := CreateAPIKey(db, APIKeyRecord{Name: "ci", Owner: "test-owner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(key, DefaultAPIKeyPrefix+"_"+record.ID+"_") || record.Role != ServiceUser {
+		t.Fatalf("unexpected key '%s' for record %+v", key, record)
+	}
+
+	verified, err := VerifyAPIKey(db, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verified.ID != record.ID || verified.LastUsedAt == nil {
+		t.Fatalf("unexpected verified record %+v", verified)
+	}
+
+	_, err = VerifyAPIKey(db, key[:len(key)-1]+"x")
+	if err != ErrAPIKeyInvalid {
+		t.Fatalf("expected ErrAPIKeyInvalid for a wrong secret, got %v", err)
+	}
+
+	authToken, _, err := ExchangeAPIKey(db, signer, key, "test", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if authToken.Subject != record.ID || authToken.SubjectType != APIKey {
+		t.Fatalf("unexpected exchanged token %+v", authToken)
+	}
+
+	err = RevokeAPIKey(db, record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = VerifyAPIKey(db, key)
+	if err != ErrAPIKeyRevoked {
+		t.Fatalf("expected ErrAPIKeyRevoked, got %v", err)
+	}
+
+	_, _, err = ExchangeAPIKey(db, signer, key, "test", time.Minute)
+	if err != ErrAPIKeyRevoked {
+		t.Fatalf("expected revoked keys not to be exchanged, got %v", err)
+	}
+
+	if !isDeactivated(t, db, authToken.ID) {
+		t.Error("expected exchanged tokens to be deactivated")
+	}
+}
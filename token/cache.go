@@ -0,0 +1,159 @@
+package token
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ttlCache is a size bounded, least-recently-used cache whose entries
+// also expire after a fixed time-to-live. It is safe for concurrent use.
+type ttlCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+
+	// removals is incremented whenever entries are deleted or purged,
+	// see setIfGeneration.
+	removals uint64
+}
+
+// ttlCacheEntry is a single entry held by a ttlCache.
+type ttlCacheEntry struct {
+	key       string
+	value     interface{}
+	expiresAt time.Time
+}
+
+// newTTLCache creates a ttlCache holding at most size entries,
+// each of which expires ttl after being set.
+func newTTLCache(size int, ttl time.Duration) *ttlCache {
+	return &ttlCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the value stored for key, if it exists and has not expired.
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*ttlCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.removeElement(elem)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(elem)
+	return entry.value, true
+}
+
+// set stores value for key, evicting the least recently used
+// entry if the cache is full.
+func (c *ttlCache) set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.setLocked(key, value)
+}
+
+// generation returns the current removal count of the cache, to be passed to
+// setIfGeneration.
+func (c *ttlCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.removals
+}
+
+// setIfGeneration stores value for key as set does, unless entries have been
+// deleted or purged since generation was read. Values loaded from the database
+// are stored this way, so that a load which raced with an invalidation does
+// not cache the stale value. It reports whether the value was stored.
+func (c *ttlCache) setIfGeneration(key string, value interface{}, generation uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.removals != generation {
+		return false
+	}
+
+	c.setLocked(key, value)
+	return true
+}
+
+// setLocked stores value for key, the caller must hold the lock.
+func (c *ttlCache) setLocked(key string, value interface{}) {
+	expiresAt := time.Now().Add(c.ttl)
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*ttlCacheEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&ttlCacheEntry{
+		key:       key,
+		value:     value,
+		expiresAt: expiresAt,
+	})
+
+	if c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// delete removes the entry stored for key.
+func (c *ttlCache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removals++
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// deleteFunc removes every entry for which match returns true.
+func (c *ttlCache) deleteFunc(match func(key string, value interface{}) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removals++
+	for elem := c.ll.Front(); elem != nil; {
+		next := elem.Next()
+		entry := elem.Value.(*ttlCacheEntry)
+		if match(entry.key, entry.value) {
+			c.removeElement(elem)
+		}
+
+		elem = next
+	}
+}
+
+// purge removes every entry from the cache.
+func (c *ttlCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removals++
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// removeElement removes elem from the cache, the caller must hold the lock.
+func (c *ttlCache) removeElement(elem *list.Element) {
+	c.ll.Remove(elem)
+	delete(c.items, elem.Value.(*ttlCacheEntry).key)
+}
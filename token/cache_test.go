@@ -0,0 +1,84 @@
+package token
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLCacheEviction(t *testing.T) {
+	cache := newTTLCache(2, time.Minute)
+	cache.set("a", 1)
+	cache.set("b", 2)
+
+	// touch "a" so that "b" is the least recently used entry
+	if _, ok := cache.get("a"); !ok {
+		t.Fatal("expected 'a' to be cached")
+	}
+
+	cache.set("c", 3)
+	if _, ok := cache.get("b"); ok {
+		t.Error("expected 'b' to be evicted")
+	}
+
+	for _, key := range []string{"a", "c"} {
+		if _, ok := cache.get(key); !ok {
+			t.Errorf("expected '%s' to be cached", key)
+		}
+	}
+}
+
+func TestTTLCacheExpiry(t *testing.T) {
+	cache := newTTLCache(10, time.Millisecond)
+	cache.set("a", 1)
+
+	time.Sleep(time.Millisecond * 5)
+	if _, ok := cache.get("a"); ok {
+		t.Error("expected 'a' to have expired")
+	}
+}
+
+func TestRevocationVerifierInvalidateSubject(t *testing.T) {
+	verifier := NewRevocationVerifier(nil, nil, RevocationConfig{})
+	verifier.cache.set("jti-1", revocationStatus{Subject: "a@example.com", Exists: true})
+	verifier.cache.set("jti-2", revocationStatus{Subject: "b@example.com", Exists: true})
+
+	verifier.handleNotification("sub:a@example.com")
+	if _, ok := verifier.cache.get("jti-1"); ok {
+		t.Error("expected 'jti-1' to be invalidated")
+	}
+
+	if _, ok := verifier.cache.get("jti-2"); !ok {
+		t.Error("expected 'jti-2' to remain cached")
+	}
+
+	verifier.handleNotification("jti:jti-2")
+	if _, ok := verifier.cache.get("jti-2"); ok {
+		t.Error("expected 'jti-2' to be invalidated")
+	}
+}
+
+func TestTTLCacheSetIfGeneration(t *testing.T) {
+	cache := newTTLCache(10, time.Minute)
+
+	generation := cache.generation()
+	if !cache.setIfGeneration("a", 1, generation) {
+		t.Fatal("expected 'a' to be stored")
+	}
+
+	// a value read before an invalidation must not be cached after it
+	generation = cache.generation()
+	cache.delete("b")
+	if cache.setIfGeneration("b", 2, generation) {
+		t.Error("expected 'b' to be discarded after a delete")
+	}
+
+	generation = cache.generation()
+	cache.purge()
+	if cache.setIfGeneration("c", 3, generation) {
+		t.Error("expected 'c' to be discarded after a purge")
+	}
+
+	if _, ok := cache.get("b"); ok {
+		t.Error("expected 'b' not to be cached")
+	}
+}
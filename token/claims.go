@@ -0,0 +1,90 @@
+package token
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// registeredClaims are the claim names written by Sign, which may
+// not be overridden using custom claims.
+var registeredClaims = map[string]bool{
+	"jti":    true,
+	"tver":   true,
+	"role":   true,
+	"aud":    true,
+	"iss":    true,
+	"sub":    true,
+	"subtyp": true,
+	"org":    true,
+	"iat":    true,
+	"nbf":    true,
+	"exp":    true,
+}
+
+// Claims holds custom (application defined) claims carried by an AuthToken,
+// such as a tenant, scopes or feature flags. Claims round-trip through Sign
+// and Verify, and are stored as JSON in the jwt_tokens table.
+type Claims map[string]interface{}
+
+// String returns the claim stored at key as a string, or an
+// empty string if it is missing or not a string.
+func (c Claims) String(key string) string {
+	val, _ := c[key].(string)
+	return val
+}
+
+// Bool returns the claim stored at key as a bool, or false
+// if it is missing or not a bool.
+func (c Claims) Bool(key string) bool {
+	val, _ := c[key].(bool)
+	return val
+}
+
+// Strings returns the claim stored at key as a string slice, or nil
+// if it is missing or not a list of strings.
+func (c Claims) Strings(key string) []string {
+	var val []string
+	if err := c.Decode(key, &val); err != nil {
+		return nil
+	}
+
+	return val
+}
+
+// Decode decodes the claim stored at key into result (a pointer), allowing
+// structured claims to be read back into typed values after Verify.
+func (c Claims) Decode(key string, result interface{}) error {
+	val, ok := c[key]
+	if !ok {
+		return fmt.Errorf("claim '%s' not found", key)
+	}
+
+	return mapstructure.Decode(val, result)
+}
+
+// Value implements driver.Valuer, storing the claims as JSON.
+func (c Claims) Value() (driver.Value, error) {
+	if c == nil {
+		return []byte("{}"), nil
+	}
+
+	return json.Marshal(c)
+}
+
+// Scan implements sql.Scanner, reading the claims from JSON.
+func (c *Claims) Scan(src interface{}) error {
+	switch data := src.(type) {
+	case nil:
+		*c = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(data, c)
+	case string:
+		return json.Unmarshal([]byte(data), c)
+	default:
+		return fmt.Errorf("failed to scan claims, unsupported type %T", src)
+	}
+}
@@ -0,0 +1,61 @@
+package token
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClaimsRoundTrip(t *testing.T) {
+	key, err := NewSigningKey("", newTestRSAKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authToken := newTestAuthToken()
+	authToken.OrgID = "org-1"
+	authToken.Claims = Claims{
+		"tenant": "acme",
+		"scopes": []string{"reports:read", "reports:write"},
+		"beta":   true,
+	}
+
+	tokenStr, err := key.Sign(authToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verified, err := key.Verify(tokenStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verified.OrgID != "org-1" {
+		t.Errorf("expected org 'org-1' but got '%s'", verified.OrgID)
+	}
+
+	if tenant := verified.Claims.String("tenant"); tenant != "acme" {
+		t.Errorf("expected tenant 'acme' but got '%s'", tenant)
+	}
+
+	if scopes := verified.Claims.Strings("scopes"); !reflect.DeepEqual(scopes, []string{"reports:read", "reports:write"}) {
+		t.Errorf("unexpected scopes %v", scopes)
+	}
+
+	if !verified.Claims.Bool("beta") {
+		t.Error("expected beta flag to be set")
+	}
+}
+
+func TestClaimsRejectRegisteredNames(t *testing.T) {
+	key, err := NewSigningKey("", newTestRSAKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authToken := newTestAuthToken()
+	authToken.Claims = Claims{"sub": "someone-else"}
+
+	if _, err := key.Sign(authToken); err == nil {
+		t.Error("expected custom claim overriding 'sub' to be rejected")
+	}
+}
@@ -0,0 +1,46 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"io/ioutil"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+func ParseECKeys(pubKeyFile, privateKeyFile string) (*ecdsa.PublicKey, *ecdsa.PrivateKey, error) {
+	privateKeyBytes, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privateKey, err := jwt.ParseECPrivateKeyFromPEM(privateKeyBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pubKeyBytes, err := ioutil.ReadFile(pubKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pubkey, err := jwt.ParseECPublicKeyFromPEM(pubKeyBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pubkey, privateKey, nil
+}
+
+func ParsePublicECKey(pubKeyFile string) (*ecdsa.PublicKey, error) {
+	pubKeyBytes, err := ioutil.ReadFile(pubKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pubkey, err := jwt.ParseECPublicKeyFromPEM(pubKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return pubkey, nil
+}
@@ -0,0 +1,52 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"io/ioutil"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+func ParseEd25519Keys(pubKeyFile, privateKeyFile string) (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	privateKeyBytes, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := jwt.ParseEdPrivateKeyFromPEM(privateKeyBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("failed to parse private key, key is not ed25519")
+	}
+
+	pubkey, err := ParsePublicEd25519Key(pubKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pubkey, privateKey, nil
+}
+
+func ParsePublicEd25519Key(pubKeyFile string) (ed25519.PublicKey, error) {
+	pubKeyBytes, err := ioutil.ReadFile(pubKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := jwt.ParseEdPublicKeyFromPEM(pubKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	pubkey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("failed to parse public key, key is not ed25519")
+	}
+
+	return pubkey, nil
+}
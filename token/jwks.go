@@ -0,0 +1,263 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// JWK is a JSON Web Key (RFC 7517) describing a single public key.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	KeyID     string `json:"kid"`
+
+	// RSA public key parameters
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// EC and OKP (Ed25519) public key parameters
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// JWKSet is a JSON Web Key Set (RFC 7517), the document served by
+// a JWKS endpoint.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public half of every key in the ring as a JWKSet,
+// ordered by kid.
+func (k *KeyRing) JWKS() JWKSet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := JWKSet{Keys: make([]JWK, 0, len(k.keys))}
+	for _, id := range k.sortedIDs() {
+		set.Keys = append(set.Keys, k.keys[id].JWK())
+	}
+
+	return set
+}
+
+// JWK returns the public half of the key as a JWK.
+func (k *Key) JWK() JWK {
+	jwk := JWK{
+		Use:       "sig",
+		Algorithm: k.method.Alg(),
+		KeyID:     k.id,
+	}
+
+	switch pubKey := k.public.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pubKey.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pubKey.E)).Bytes())
+	case *ecdsa.PublicKey:
+		// coordinates are padded to the curve size as required by RFC 7518
+		size := (pubKey.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = pubKey.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(padBytes(pubKey.X.Bytes(), size))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(padBytes(pubKey.Y.Bytes(), size))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pubKey)
+	}
+
+	return jwk
+}
+
+// JWKSHandler returns an http.Handler serving the ring's public keys as a
+// JWKS document (typically mounted at /.well-known/jwks.json), allowing
+// downstream services to verify tokens without distributing PEM files.
+func (k *KeyRing) JWKSHandler() http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		res.Header().Set("Content-Type", "application/jwk-set+json")
+		res.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(res).Encode(k.JWKS())
+	})
+}
+
+// ParseJWKS parses a JWKS document, returning a KeyRing holding each key as
+// a verification key. Keys with an unsupported key type or curve are skipped.
+func ParseJWKS(data []byte) (*KeyRing, error) {
+	set := JWKSet{}
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode jwks: %v", err)
+	}
+
+	ring := NewKeyRing()
+	for _, jwk := range set.Keys {
+		pubKey, err := jwk.PublicKey()
+		if err == errUnsupportedJWK {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		err = ring.AddVerificationKey(jwk.KeyID, pubKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ring, nil
+}
+
+// FetchJWKS retrieves and parses the JWKS document served at url.
+func FetchJWKS(url string) (*KeyRing, error) {
+	client := http.Client{Timeout: time.Second * 10}
+	res, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch jwks, unexpected status code %d", res.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseJWKS(data)
+}
+
+// errUnsupportedJWK is returned when decoding a JWK of an unsupported key type.
+var errUnsupportedJWK = errors.New("unsupported jwk key type")
+
+// minRSAKeyBits is the smallest RSA modulus accepted from a JWK.
+const minRSAKeyBits = 2048
+
+// PublicKey decodes the public key described by the JWK. When the JWK
+// names an algorithm, it must be the algorithm tokens are verified with for
+// the key type (see Key), otherwise an error is returned.
+func (j JWK) PublicKey() (crypto.PublicKey, error) {
+	pubKey, err := j.decodePublicKey()
+	if err != nil || j.Algorithm == "" {
+		return pubKey, err
+	}
+
+	method, err := signingMethodForKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if method.Alg() != j.Algorithm {
+		return nil, fmt.Errorf("failed to decode jwk '%s', algorithm '%s' does not match key type '%s'", j.KeyID, j.Algorithm, j.KeyType)
+	}
+
+	return pubKey, nil
+}
+
+// decodePublicKey decodes the key parameters of the JWK for PublicKey.
+func (j JWK) decodePublicKey() (crypto.PublicKey, error) {
+	switch j.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(j.N)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode jwk '%s' modulus: %v", j.KeyID, err)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(j.E)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode jwk '%s' exponent: %v", j.KeyID, err)
+		}
+
+		pubKey := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+
+		if pubKey.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("failed to decode jwk '%s', rsa modulus must be at least %d bits", j.KeyID, minRSAKeyBits)
+		}
+
+		return pubKey, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errUnsupportedJWK
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode jwk '%s' x coordinate: %v", j.KeyID, err)
+		}
+
+		y, err := base64.RawURLEncoding.DecodeString(j.Y)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode jwk '%s' y coordinate: %v", j.KeyID, err)
+		}
+
+		pubKey := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+
+		if !curve.IsOnCurve(pubKey.X, pubKey.Y) {
+			return nil, fmt.Errorf("failed to decode jwk '%s', point is not on curve", j.KeyID)
+		}
+
+		return pubKey, nil
+	case "OKP":
+		if j.Curve != "Ed25519" {
+			return nil, errUnsupportedJWK
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode jwk '%s' x coordinate: %v", j.KeyID, err)
+		}
+
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("failed to decode jwk '%s', invalid ed25519 key size", j.KeyID)
+		}
+
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, errUnsupportedJWK
+	}
+}
+
+// padBytes left-pads b with zeros to the provided size.
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
@@ -0,0 +1,258 @@
+package token
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// ErrAlgorithmMismatch is returned by verification when the alg header of
+// a token does not match the algorithm of the key used to verify it.
+var ErrAlgorithmMismatch = errors.New("user error: failed to authenticate, token algorithm does not match key")
+
+// Signer is implemented by types able to sign AuthTokens, returning
+// the JWT token string.
+type Signer interface {
+	Sign(authToken AuthToken) (string, error)
+}
+
+// Verifier is implemented by types able to validate JWT token strings,
+// returning the AuthToken claims.
+type Verifier interface {
+	Verify(inputStr string) (AuthToken, error)
+	VerifyIgnoringExpiry(inputStr string) (AuthToken, error)
+}
+
+// ContextVerifier is implemented by Verifiers which consult the database
+// (such as RevocationVerifier), so that the cancellation of a request reaches
+// their queries. The middleware and interceptors of this package use it when
+// available.
+type ContextVerifier interface {
+	Verifier
+	VerifyContext(ctx context.Context, inputStr string) (AuthToken, error)
+	VerifyIgnoringExpiryContext(ctx context.Context, inputStr string) (AuthToken, error)
+}
+
+// verifyContext verifies inputStr using verifier, passing ctx along
+// when verifier is a ContextVerifier.
+func verifyContext(ctx context.Context, verifier Verifier, inputStr string, ignoreExpiry bool) (AuthToken, error) {
+	if contextVerifier, ok := verifier.(ContextVerifier); ok {
+		if ignoreExpiry {
+			return contextVerifier.VerifyIgnoringExpiryContext(ctx, inputStr)
+		}
+
+		return contextVerifier.VerifyContext(ctx, inputStr)
+	}
+
+	if ignoreExpiry {
+		return verifier.VerifyIgnoringExpiry(inputStr)
+	}
+
+	return verifier.Verify(inputStr)
+}
+
+// Key is a single signing (or verification-only) key. The signing algorithm
+// is inferred from the key type: RSA keys use RS256, ECDSA keys use ES256,
+// ES384 or ES512 (by curve) and Ed25519 keys use EdDSA.
+type Key struct {
+	id         string
+	method     jwt.SigningMethod
+	private    crypto.Signer
+	public     crypto.PublicKey
+	validation ValidationConfig
+}
+
+// NewSigningKey creates a Key from a private key (*rsa.PrivateKey,
+// *ecdsa.PrivateKey or ed25519.PrivateKey). The kid is optional when the
+// key is used on its own, but required when added to a KeyRing.
+func NewSigningKey(kid string, key crypto.Signer) (*Key, error) {
+	if key == nil {
+		return nil, errors.New("failed to create key, key is nil")
+	}
+
+	method, err := signingMethodForKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{
+		id:      kid,
+		method:  method,
+		private: key,
+		public:  key.Public(),
+	}, nil
+}
+
+// NewVerificationKey creates a verification-only Key from a public key
+// (*rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey).
+func NewVerificationKey(kid string, key crypto.PublicKey) (*Key, error) {
+	if key == nil {
+		return nil, errors.New("failed to create key, key is nil")
+	}
+
+	method, err := signingMethodForKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{
+		id:     kid,
+		method: method,
+		public: key,
+	}, nil
+}
+
+// ID returns the key ID (kid) of the key.
+func (k *Key) ID() string {
+	return k.id
+}
+
+// Algorithm returns the JWS algorithm (alg header) used by the key.
+func (k *Key) Algorithm() string {
+	return k.method.Alg()
+}
+
+// Public returns the public half of the key.
+func (k *Key) Public() crypto.PublicKey {
+	return k.public
+}
+
+// CanSign reports whether the key holds a private key.
+func (k *Key) CanSign() bool {
+	return k.private != nil
+}
+
+// SetValidationConfig sets the claim checks used when verifying tokens with
+// the key. It should be called before the key is shared between goroutines.
+func (k *Key) SetValidationConfig(conf ValidationConfig) {
+	k.validation = conf
+}
+
+// Sign creates and signs a JWT token using the provided AuthToken,
+// stamping the kid header when the key has an ID, and the configured
+// issuer when the token does not carry one.
+func (k *Key) Sign(authToken AuthToken) (string, error) {
+	if k.private == nil {
+		return "", fmt.Errorf("failed to sign token, key '%s' is verification-only", k.id)
+	}
+
+	if authToken.Issuer == "" {
+		authToken.Issuer = k.validation.Issuer
+	}
+
+	return sign(authToken, k.method, k.id, k.private)
+}
+
+// Verify validates a JWT token string signed by this key.
+func (k *Key) Verify(inputStr string) (AuthToken, error) {
+	return verify(inputStr, k.keyFunc, k.validation, false)
+}
+
+// VerifyIgnoringExpiry parses and returns the AuthToken (claims) for an expired
+// token, but only if the token is valid in all other ways.
+func (k *Key) VerifyIgnoringExpiry(inputStr string) (AuthToken, error) {
+	return verify(inputStr, k.keyFunc, k.validation, true)
+}
+
+// keyFunc returns the public key for a parsed token, rejecting tokens
+// whose alg header does not match the key.
+func (k *Key) keyFunc(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() != k.method.Alg() {
+		return nil, ErrAlgorithmMismatch
+	}
+
+	return k.public, nil
+}
+
+// signingMethodForKey infers the jwt signing method from a public key.
+func signingMethodForKey(key crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch pubKey := key.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		switch pubKey.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		}
+
+		return nil, fmt.Errorf("unsupported ecdsa curve '%s'", pubKey.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// ParsePrivateKey reads a PEM encoded RSA, EC or Ed25519 private key
+// from the provided file, detecting the key type automatically.
+func ParsePrivateKey(privateKeyFile string) (crypto.Signer, error) {
+	privateKeyBytes, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(privateKeyBytes)
+	if block == nil {
+		return nil, jwt.ErrKeyMustBePEMEncoded
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return jwt.ParseRSAPrivateKeyFromPEM(privateKeyBytes)
+	case "EC PRIVATE KEY":
+		return jwt.ParseECPrivateKeyFromPEM(privateKeyBytes)
+	}
+
+	// PKCS8 encoded keys may be of any type
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(privateKeyBytes); err == nil {
+		return key, nil
+	}
+
+	if key, err := jwt.ParseECPrivateKeyFromPEM(privateKeyBytes); err == nil {
+		return key, nil
+	}
+
+	key, err := jwt.ParseEdPrivateKeyFromPEM(privateKeyBytes)
+	if err != nil {
+		return nil, errors.New("failed to parse private key, unsupported key type")
+	}
+
+	return key.(crypto.Signer), nil
+}
+
+// ParsePublicKey reads a PEM encoded RSA, EC or Ed25519 public key
+// from the provided file, detecting the key type automatically.
+func ParsePublicKey(pubKeyFile string) (crypto.PublicKey, error) {
+	pubKeyBytes, err := ioutil.ReadFile(pubKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(pubKeyBytes); err == nil {
+		return key, nil
+	}
+
+	if key, err := jwt.ParseECPublicKeyFromPEM(pubKeyBytes); err == nil {
+		return key, nil
+	}
+
+	key, err := jwt.ParseEdPublicKeyFromPEM(pubKeyBytes)
+	if err != nil {
+		return nil, errors.New("failed to parse public key, unsupported key type")
+	}
+
+	return key, nil
+}
@@ -0,0 +1,197 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"testing"
+)
+
+func TestKeyAlgorithms(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := map[string]struct {
+		Key       crypto.Signer
+		Algorithm string
+	}{
+		"should sign rsa keys with RS256":     {Key: newTestRSAKey(t), Algorithm: "RS256"},
+		"should sign P-256 keys with ES256":   {Key: ecKey, Algorithm: "ES256"},
+		"should sign ed25519 keys with EdDSA": {Key: edKey, Algorithm: "EdDSA"},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			key, err := NewSigningKey("kid", scene.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if key.Algorithm() != scene.Algorithm {
+				t.Errorf("expected '%s' but got '%s'", scene.Algorithm, key.Algorithm())
+			}
+
+			tokenStr, err := key.Sign(newTestAuthToken())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := key.Verify(tokenStr); err != nil {
+				t.Errorf("expected token to verify but got '%v'", err)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsAlgorithmMismatch(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := NewSigningKey("", ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenStr, err := key.Sign(newTestAuthToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey := newTestRSAKey(t)
+	if _, err := Verify(tokenStr, &rsaKey.PublicKey); err != ErrAlgorithmMismatch {
+		t.Errorf("expected '%v' but got '%v'", ErrAlgorithmMismatch, err)
+	}
+}
+
+func TestMixedKeyRingJWKS(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ring := NewKeyRing()
+	if err := ring.AddSigningKey("ec", ecKey); err != nil {
+		t.Fatal(err)
+	}
+
+	ecToken, err := ring.Sign(newTestAuthToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ring.AddSigningKey("ed", edKey); err != nil {
+		t.Fatal(err)
+	}
+
+	edToken, err := ring.Sign(newTestAuthToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(ring.JWKS())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	downstream, err := ParseJWKS(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tokenStr := range []string{ecToken, edToken} {
+		if _, err := downstream.Verify(tokenStr); err != nil {
+			t.Errorf("expected token to verify against jwks but got '%v'", err)
+		}
+	}
+}
+
+func TestJWKPublicKeyRejectsSmallRSAKeys(t *testing.T) {
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwk := JWK{
+		KeyType: "RSA",
+		KeyID:   "small",
+		N:       base64.RawURLEncoding.EncodeToString(smallKey.N.Bytes()),
+		E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(smallKey.E)).Bytes()),
+	}
+
+	if _, err := jwk.PublicKey(); err == nil {
+		t.Error("expected 1024 bit rsa key to be rejected")
+	}
+
+	key, err := NewSigningKey("large", newTestRSAKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := key.JWK().PublicKey(); err != nil {
+		t.Errorf("expected 2048 bit rsa key to be accepted but got '%v'", err)
+	}
+}
+
+func TestJWKPublicKeyRejectsAlgorithmMismatch(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := NewSigningKey("rsa", newTestRSAKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := NewSigningKey("ec", ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := map[string]struct {
+		Algorithm string
+		JWK       JWK
+		Valid     bool
+	}{
+		"should accept matching algorithms":       {Algorithm: "ES256", JWK: key.JWK(), Valid: true},
+		"should accept keys without an algorithm": {Algorithm: "", JWK: key.JWK(), Valid: true},
+		"should reject rsa algorithms on ec keys": {Algorithm: "RS256", JWK: key.JWK(), Valid: false},
+		"should reject ec algorithms on rsa keys": {Algorithm: "ES256", JWK: rsaKey.JWK(), Valid: false},
+		"should reject other curve algorithms":    {Algorithm: "ES384", JWK: key.JWK(), Valid: false},
+		"should reject hmac algorithms":           {Algorithm: "HS256", JWK: rsaKey.JWK(), Valid: false},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			jwk := scene.JWK
+			jwk.Algorithm = scene.Algorithm
+
+			_, err := jwk.PublicKey()
+			if scene.Valid && err != nil {
+				t.Errorf("expected jwk to be accepted but got '%v'", err)
+			} else if !scene.Valid && err == nil {
+				t.Error("expected jwk to be rejected")
+			}
+		})
+	}
+}
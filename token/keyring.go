@@ -0,0 +1,213 @@
+package token
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// KeyRing holds a set of keys identified by key ID (kid), allowing signing
+// keys to be rotated without invalidating tokens signed by the previous key.
+// Tokens are signed using the active signing key (stamping the kid header),
+// and verified using whichever key in the ring matches the token's kid.
+// A KeyRing is safe for concurrent use.
+type KeyRing struct {
+	mu         sync.RWMutex
+	keys       map[string]*Key
+	signingID  string
+	validation ValidationConfig
+}
+
+// NewKeyRing creates an empty KeyRing. Keys must be added using
+// AddSigningKey or AddVerificationKey before the ring is used.
+func NewKeyRing() *KeyRing {
+	return &KeyRing{
+		keys: make(map[string]*Key),
+	}
+}
+
+// AddSigningKey adds a private key (*rsa.PrivateKey, *ecdsa.PrivateKey or
+// ed25519.PrivateKey) to the ring and makes it the active signing key. Any
+// previously active key remains in the ring (retiring) and will still be used
+// to verify tokens it signed until it is removed.
+func (k *KeyRing) AddSigningKey(kid string, key crypto.Signer) error {
+	signingKey, err := NewSigningKey(kid, key)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	err = k.add(signingKey)
+	if err != nil {
+		return err
+	}
+
+	k.signingID = kid
+	return nil
+}
+
+// AddVerificationKey adds a public key (*rsa.PublicKey, *ecdsa.PublicKey or
+// ed25519.PublicKey) to the ring. The key will be used to verify tokens with
+// a matching kid, but never to sign new tokens.
+func (k *KeyRing) AddVerificationKey(kid string, key crypto.PublicKey) error {
+	verificationKey, err := NewVerificationKey(kid, key)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.add(verificationKey)
+}
+
+// add inserts a key into the ring, the caller must hold the write lock.
+func (k *KeyRing) add(key *Key) error {
+	if key.id == "" {
+		return errors.New("failed to add key, kid is required")
+	}
+
+	if _, exists := k.keys[key.id]; exists {
+		return fmt.Errorf("failed to add key, kid '%s' already exists", key.id)
+	}
+
+	k.keys[key.id] = key
+	return nil
+}
+
+// SetSigningKey promotes an existing private key in the ring to be the
+// active signing key.
+func (k *KeyRing) SetSigningKey(kid string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key, ok := k.keys[kid]
+	if !ok {
+		return fmt.Errorf("failed to set signing key, kid '%s' not found", kid)
+	}
+
+	if !key.CanSign() {
+		return fmt.Errorf("failed to set signing key, kid '%s' is verification-only", kid)
+	}
+
+	k.signingID = kid
+	return nil
+}
+
+// RemoveKey removes a (retired) key from the ring. Tokens signed by the key
+// will fail verification with ErrUnknownKey once it has been removed. The
+// active signing key cannot be removed.
+func (k *KeyRing) RemoveKey(kid string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if kid == k.signingID {
+		return fmt.Errorf("failed to remove key, kid '%s' is the active signing key", kid)
+	}
+
+	delete(k.keys, kid)
+	return nil
+}
+
+// KeyIDs returns the sorted key IDs of every key in the ring.
+func (k *KeyRing) KeyIDs() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.sortedIDs()
+}
+
+// sortedIDs returns the sorted key IDs of the ring, the caller must hold the lock.
+func (k *KeyRing) sortedIDs() []string {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+// SigningKeyID returns the kid of the active signing key, or an empty
+// string if the ring holds no signing key.
+func (k *KeyRing) SigningKeyID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.signingID
+}
+
+// SetValidationConfig sets the claim checks used when verifying tokens
+// with the ring.
+func (k *KeyRing) SetValidationConfig(conf ValidationConfig) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.validation = conf
+}
+
+// validationConfig returns the claim checks used when verifying tokens.
+func (k *KeyRing) validationConfig() ValidationConfig {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.validation
+}
+
+// Sign creates and signs a JWT token using the provided AuthToken and the
+// active signing key, stamping the key's kid in the token header and the
+// configured issuer when the token does not carry one.
+func (k *KeyRing) Sign(authToken AuthToken) (string, error) {
+	k.mu.RLock()
+	key, ok := k.keys[k.signingID]
+	issuer := k.validation.Issuer
+	k.mu.RUnlock()
+
+	if !ok {
+		return "", errors.New("failed to sign token, key ring has no signing key")
+	}
+
+	if authToken.Issuer == "" {
+		authToken.Issuer = issuer
+	}
+
+	return key.Sign(authToken)
+}
+
+// Verify validates a JWT token string using the key matching its kid header,
+// behaving otherwise exactly like the package level Verify function.
+func (k *KeyRing) Verify(inputStr string) (AuthToken, error) {
+	return verify(inputStr, k.keyFunc, k.validationConfig(), false)
+}
+
+// VerifyIgnoringExpiry parses and returns the AuthToken (claims) for an expired
+// token, but only if the token is valid in all other ways.
+func (k *KeyRing) VerifyIgnoringExpiry(inputStr string) (AuthToken, error) {
+	return verify(inputStr, k.keyFunc, k.validationConfig(), true)
+}
+
+// keyFunc looks up the verification key for a parsed token by kid. Tokens
+// without a kid (signed before key rotation was adopted) are verified against
+// the active signing key.
+func (k *KeyRing) keyFunc(token *jwt.Token) (interface{}, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = k.signingID
+	}
+
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return key.keyFunc(token)
+}
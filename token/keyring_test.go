@@ -0,0 +1,129 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func newTestAuthToken() AuthToken {
+	now := time.Now().UTC()
+	return AuthToken{
+		ID:           "test-jti",
+		TokenVersion: 1,
+		Role:         OrgUser,
+		Audience:     "test",
+		Subject:      "user@example.com",
+		SubjectType:  Email,
+		IssuedAt:     now,
+		NotBefore:    now,
+		ExpiresAt:    now.Add(time.Hour),
+	}
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	oldKey, newKey := newTestRSAKey(t), newTestRSAKey(t)
+
+	ring := NewKeyRing()
+	if err := ring.AddSigningKey("2021-01", oldKey); err != nil {
+		t.Fatal(err)
+	}
+
+	oldToken, err := ring.Sign(newTestAuthToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacyToken, err := Sign(newTestAuthToken(), oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ring.AddSigningKey("2021-02", newKey); err != nil {
+		t.Fatal(err)
+	}
+
+	newToken, err := ring.Sign(newTestAuthToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ring.Verify(oldToken); err != nil {
+		t.Errorf("expected token signed by retiring key to verify but got '%v'", err)
+	}
+
+	if _, err := ring.Verify(newToken); err != nil {
+		t.Errorf("expected token signed by active key to verify but got '%v'", err)
+	}
+
+	if _, err := ring.Verify(legacyToken); err == nil {
+		t.Error("expected legacy token without kid to be checked against the active key and fail")
+	}
+
+	if err := ring.RemoveKey("2021-02"); err == nil {
+		t.Error("expected removing the active signing key to fail")
+	}
+
+	if err := ring.RemoveKey("2021-01"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ring.Verify(oldToken); err != ErrUnknownKey {
+		t.Errorf("expected '%v' but got '%v'", ErrUnknownKey, err)
+	}
+}
+
+func TestKeyRingJWKS(t *testing.T) {
+	ring := NewKeyRing()
+	if err := ring.AddSigningKey("primary", newTestRSAKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	tokenStr, err := ring.Sign(newTestAuthToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := httptest.NewRecorder()
+	ring.JWKSHandler().ServeHTTP(res, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+
+	set := JWKSet{}
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(set.Keys) != 1 || set.Keys[0].KeyID != "primary" || set.Keys[0].KeyType != "RSA" {
+		t.Fatalf("unexpected jwks contents %+v", set)
+	}
+
+	body, _ := json.Marshal(set)
+	downstream, err := ParseJWKS(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authToken, err := downstream.Verify(tokenStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if authToken.Subject != "user@example.com" {
+		t.Errorf("expected subject 'user@example.com' but got '%s'", authToken.Subject)
+	}
+
+	if _, err := downstream.Sign(newTestAuthToken()); err == nil {
+		t.Error("expected signing with a verification-only key ring to fail")
+	}
+}
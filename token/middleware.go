@@ -0,0 +1,144 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrMissingToken is returned when a request carries no Bearer token.
+var ErrMissingToken = errors.New("user error: failed to authenticate, no bearer token provided")
+
+// HTTPMiddleware returns net/http middleware which extracts the Bearer token
+// from the Authorization header, verifies it using verifier and attaches the
+// AuthToken to the request context (see FromContext). Requests without a
+// valid token are rejected with 401 Unauthorized, while failures unrelated to
+// the token (such as database errors) are answered with 500 Internal Server
+// Error.
+func HTTPMiddleware(verifier Verifier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			tokenStr, err := parseBearerToken(req.Header.Get("Authorization"))
+			if err != nil {
+				writeUnauthorized(res, err)
+				return
+			}
+
+			authToken, err := verifyContext(req.Context(), verifier, tokenStr, false)
+			if err != nil {
+				if !isAuthError(err) {
+					http.Error(res, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+
+				writeUnauthorized(res, err)
+				return
+			}
+
+			next.ServeHTTP(res, req.WithContext(WithAuthToken(req.Context(), authToken)))
+		})
+	}
+}
+
+// RequireRoles returns net/http middleware which only allows requests whose
+// AuthToken (attached by HTTPMiddleware) has one of the provided roles. It is
+// intended to wrap individual routes, responding with 401 Unauthorized when
+// no token is present and 403 Forbidden when the role is not permitted.
+func RequireRoles(roles ...Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			authToken := FromContext(req.Context())
+			if authToken == nil {
+				writeUnauthorized(res, ErrMissingToken)
+				return
+			}
+
+			if !hasRole(*authToken, roles) {
+				http.Error(res, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(res, req)
+		})
+	}
+}
+
+// parseBearerToken extracts the token from an Authorization header value.
+func parseBearerToken(header string) (string, error) {
+	const prefix = "bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", ErrMissingToken
+	}
+
+	return strings.TrimSpace(header[len(prefix):]), nil
+}
+
+// hasRole reports whether the token has one of the provided roles.
+func hasRole(authToken AuthToken, roles []Role) bool {
+	for _, role := range roles {
+		if authToken.Role == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authErrors are the verification errors caused by the token itself, see
+// isAuthError.
+var authErrors = []error{
+	ErrMissingToken,
+	ErrTokenExpired,
+	ErrTokenOutdated,
+	ErrTokenDeactivated,
+	ErrTokenUnknown,
+	ErrUnknownKey,
+	ErrAlgorithmMismatch,
+	ErrInvalidAudience,
+	ErrInvalidIssuer,
+}
+
+// isAuthError reports whether a verification error was caused by the token
+// (so that the client must authenticate again), rather than by a failure
+// such as a database outage.
+func isAuthError(err error) bool {
+	if _, ok := err.(*invalidTokenError); ok {
+		return true
+	}
+
+	for _, authErr := range authErrors {
+		if err == authErr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authErrorDescription maps verification errors to a description which is
+// safe to return to the client.
+func authErrorDescription(err error) string {
+	switch err {
+	case ErrTokenExpired:
+		return "token has expired"
+	case ErrTokenOutdated:
+		return "token is outdated"
+	case ErrMissingToken:
+		return "no bearer token provided"
+	default:
+		return "token is invalid"
+	}
+}
+
+// writeUnauthorized responds with 401 Unauthorized and a RFC 6750
+// WWW-Authenticate challenge describing the failure.
+func writeUnauthorized(res http.ResponseWriter, err error) {
+	if err == ErrMissingToken {
+		res.Header().Set("WWW-Authenticate", "Bearer")
+	} else {
+		res.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description="%s"`, authErrorDescription(err)))
+	}
+
+	http.Error(res, "Unauthorized", http.StatusUnauthorized)
+}
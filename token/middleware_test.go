@@ -0,0 +1,77 @@
+package token
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPMiddleware(t *testing.T) {
+	key, err := NewSigningKey("", newTestRSAKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid, err := key.Sign(newTestAuthToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiredToken := newTestAuthToken()
+	expiredToken.ExpiresAt = time.Now().UTC().Add(-time.Minute)
+	expired, err := key.Sign(expiredToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := HTTPMiddleware(key)(RequireRoles(OrgUser, AdminUser)(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if FromContext(req.Context()) == nil {
+			t.Error("expected auth token in request context")
+		}
+	})))
+
+	adminOnly := HTTPMiddleware(key)(RequireRoles(AdminUser)(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {})))
+	failing := HTTPMiddleware(failingVerifier{})(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+
+	scenarios := map[string]struct {
+		Handler       http.Handler
+		Authorization string
+		Status        int
+	}{
+		"should accept valid tokens":        {Handler: handler, Authorization: "Bearer " + valid, Status: http.StatusOK},
+		"should reject missing tokens":      {Handler: handler, Authorization: "", Status: http.StatusUnauthorized},
+		"should reject expired tokens":      {Handler: handler, Authorization: "Bearer " + expired, Status: http.StatusUnauthorized},
+		"should reject malformed tokens":    {Handler: handler, Authorization: "Bearer abc", Status: http.StatusUnauthorized},
+		"should reject non-permitted roles": {Handler: adminOnly, Authorization: "Bearer " + valid, Status: http.StatusForbidden},
+		"should fail on verifier errors":    {Handler: failing, Authorization: "Bearer " + valid, Status: http.StatusInternalServerError},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if scene.Authorization != "" {
+				req.Header.Set("Authorization", scene.Authorization)
+			}
+
+			res := httptest.NewRecorder()
+			scene.Handler.ServeHTTP(res, req)
+			if res.Code != scene.Status {
+				t.Errorf("expected status %d but got %d", scene.Status, res.Code)
+			}
+		})
+	}
+}
+
+// failingVerifier is a Verifier which fails as a verifier backed by an
+// unreachable database would.
+type failingVerifier struct{}
+
+func (failingVerifier) Verify(string) (AuthToken, error) {
+	return AuthToken{}, errors.New("dial tcp: connection refused")
+}
+
+func (failingVerifier) VerifyIgnoringExpiry(string) (AuthToken, error) {
+	return AuthToken{}, errors.New("dial tcp: connection refused")
+}
@@ -0,0 +1,15 @@
+package token
+
+import (
+	"embed"
+
+	"github.com/cosmotek/api-commons/database"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migrations is the schema of the tables used by this package (jwt_tokens,
+// jwt_refresh_tokens, api_keys and jwt_token_versions), applied by
+// database.Database.SyncMigrations when included in database.Config.Migrations.
+var Migrations = database.NewEmbeddedMigrationSource("api-commons/token", migrationFiles, "migrations")
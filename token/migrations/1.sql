@@ -0,0 +1,50 @@
+-- jwt_tokens records every issued token (session), see RecordTokenCreate.
+CREATE TABLE IF NOT EXISTS jwt_tokens (
+	jti TEXT PRIMARY KEY,
+	token_version INTEGER NOT NULL,
+	role TEXT NOT NULL DEFAULT '',
+	audience TEXT NOT NULL DEFAULT '',
+	subject TEXT NOT NULL DEFAULT '',
+	subject_type TEXT NOT NULL DEFAULT '',
+	issued_at TIMESTAMPTZ NOT NULL,
+	not_before TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL,
+	refresh_count BIGINT NOT NULL DEFAULT 0,
+	deactivated BOOLEAN NOT NULL DEFAULT FALSE,
+	org_id TEXT NOT NULL DEFAULT '',
+	claims JSONB NOT NULL DEFAULT '{}',
+	issuer TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip_address TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS jwt_tokens_subject_idx ON jwt_tokens (subject);
+CREATE INDEX IF NOT EXISTS jwt_tokens_expires_at_idx ON jwt_tokens (expires_at);
+
+-- jwt_refresh_tokens stores hashed refresh tokens, see Refresher.
+CREATE TABLE IF NOT EXISTS jwt_refresh_tokens (
+	token_hash TEXT PRIMARY KEY,
+	jti TEXT NOT NULL REFERENCES jwt_tokens (jti) ON DELETE CASCADE,
+	expires_at TIMESTAMPTZ NOT NULL,
+	consumed BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS jwt_refresh_tokens_jti_idx ON jwt_refresh_tokens (jti);
+
+-- api_keys stores hashed API keys, see CreateAPIKey.
+CREATE TABLE IF NOT EXISTS api_keys (
+	id TEXT PRIMARY KEY,
+	prefix TEXT NOT NULL,
+	key_hash TEXT NOT NULL,
+	name TEXT NOT NULL DEFAULT '',
+	owner TEXT NOT NULL DEFAULT '',
+	role TEXT NOT NULL DEFAULT '',
+	org_id TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ,
+	last_used_at TIMESTAMPTZ,
+	revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_owner_idx ON api_keys (owner);
@@ -0,0 +1,7 @@
+-- jwt_token_versions stores the minimum token version of each subject, the
+-- "*" subject holds the system-wide minimum, see BumpTokenVersion.
+CREATE TABLE IF NOT EXISTS jwt_token_versions (
+	subject TEXT PRIMARY KEY,
+	min_version INTEGER NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,21 @@
+package token
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func TestMigrationsCoverTokenColumns(t *testing.T) {
+	schema, err := fs.ReadFile(Migrations.FS, "1.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, column := range strings.Split(authTokenColumns, ",") {
+		column = strings.TrimSpace(column)
+		if !strings.Contains(string(schema), "\t"+column+" ") {
+			t.Errorf("expected jwt_tokens migration to define column '%s'", column)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrAccessDenied is returned by Policy.Check when the actor is
+// not permitted to access a resource.
+var ErrAccessDenied = errors.New("user error: access denied")
+
+// Permission is an application defined identifier for an action
+// (e.g. "reports:read") which may be granted to roles.
+type Permission string
+
+// AllPermissions may be granted to a role to allow every permission.
+const AllPermissions Permission = "*"
+
+// Scope determines which resources an actor may access using the
+// permissions granted to its role.
+type Scope int
+
+const (
+	// ScopePublic allows access to public resources only.
+	ScopePublic Scope = iota
+
+	// ScopePersonal allows access to public resources as well as
+	// resources owned by the actor (matching subject).
+	ScopePersonal
+
+	// ScopeOrg allows access to public resources as well as
+	// resources owned by the actor's org.
+	ScopeOrg
+
+	// ScopeAll allows access to every resource in the system.
+	ScopeAll
+)
+
+// ResourceOwner describes who owns a resource being accessed.
+type ResourceOwner struct {
+	// Public marks data that any authenticated actor may access.
+	Public bool
+
+	// OrgID is the org owning the resource, if any.
+	OrgID string
+
+	// Subject is the actor (user) owning the resource, if any.
+	Subject string
+}
+
+// rolePolicy holds the permissions and scope registered for a single role.
+type rolePolicy struct {
+	scope       Scope
+	permissions map[Permission]bool
+	parents     []Role
+}
+
+// Policy is a declarative permission policy mapping roles to permissions and
+// access scopes, with support for roles inheriting the rights of other roles.
+// A Policy is safe for concurrent use.
+type Policy struct {
+	mu    sync.RWMutex
+	roles map[Role]*rolePolicy
+	orgOf func(AuthToken) string
+}
+
+// NewPolicy creates an empty Policy in which no role has any permissions.
+func NewPolicy() *Policy {
+	return &Policy{
+		roles: make(map[Role]*rolePolicy),
+		orgOf: func(authToken AuthToken) string { return authToken.OrgID },
+	}
+}
+
+// DefaultPolicy creates a Policy describing the rules documented on the
+// Role constants: AdminUser may access everything, OrgUser may access public
+// and org owned data, Vuer may access public and personally owned data and
+// ServiceUser has the same rights as OrgUser. Permissions must still be
+// granted to OrgUser and Vuer by the application.
+func DefaultPolicy() *Policy {
+	policy := NewPolicy()
+	policy.SetScope(AdminUser, ScopeAll)
+	policy.Grant(AdminUser, AllPermissions)
+	policy.SetScope(OrgUser, ScopeOrg)
+	policy.SetScope(Vuer, ScopePersonal)
+
+	// cannot fail, no other inheritance has been registered
+	policy.Inherit(ServiceUser, OrgUser)
+	return policy
+}
+
+// role returns the policy for role, creating it if required. The
+// caller must hold the write lock.
+func (p *Policy) role(role Role) *rolePolicy {
+	rp, ok := p.roles[role]
+	if !ok {
+		rp = &rolePolicy{permissions: make(map[Permission]bool)}
+		p.roles[role] = rp
+	}
+
+	return rp
+}
+
+// Grant grants the provided permissions to role.
+func (p *Policy) Grant(role Role, permissions ...Permission) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rp := p.role(role)
+	for _, permission := range permissions {
+		rp.permissions[permission] = true
+	}
+}
+
+// SetScope sets the access scope of role.
+func (p *Policy) SetScope(role Role, scope Scope) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.role(role).scope = scope
+}
+
+// Inherit gives role every permission (and the scope) of each parent role,
+// including permissions granted to the parents after this call.
+func (p *Policy) Inherit(role Role, parents ...Role) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, parent := range parents {
+		if p.inherits(parent, role, map[Role]bool{}) {
+			return fmt.Errorf("failed to inherit role '%s', role '%s' already inherits from it", parent, role)
+		}
+	}
+
+	rp := p.role(role)
+	rp.parents = append(rp.parents, parents...)
+	return nil
+}
+
+// SetOrgResolver sets the function used to determine which org an actor
+// belongs to when checking ScopeOrg access, by default the OrgID claim of
+// the actor's AuthToken is used.
+func (p *Policy) SetOrgResolver(orgOf func(AuthToken) string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.orgOf = orgOf
+}
+
+// HasPermission reports whether role has been granted permission,
+// directly or through inheritance.
+func (p *Policy) HasPermission(role Role, permission Permission) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.hasPermission(role, permission, map[Role]bool{})
+}
+
+// Check returns nil if the actor described by authToken may perform
+// permission on a resource owned by owner, or ErrAccessDenied.
+func (p *Policy) Check(authToken AuthToken, permission Permission, owner ResourceOwner) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if !p.hasPermission(authToken.Role, permission, map[Role]bool{}) {
+		return ErrAccessDenied
+	}
+
+	switch p.scope(authToken.Role, map[Role]bool{}) {
+	case ScopeAll:
+		return nil
+	case ScopeOrg:
+		if orgID := p.orgOf(authToken); owner.OrgID != "" && orgID != "" && owner.OrgID == orgID {
+			return nil
+		}
+	case ScopePersonal:
+		if owner.Subject != "" && owner.Subject == authToken.Subject {
+			return nil
+		}
+	}
+
+	if owner.Public {
+		return nil
+	}
+
+	return ErrAccessDenied
+}
+
+// CanAccess reports whether the actor described by the AuthToken in ctx
+// may perform permission on a resource owned by owner. If ctx carries no
+// AuthToken, access is denied.
+func (p *Policy) CanAccess(ctx context.Context, permission Permission, owner ResourceOwner) bool {
+	authToken := FromContext(ctx)
+	if authToken == nil {
+		return false
+	}
+
+	return p.Check(*authToken, permission, owner) == nil
+}
+
+// hasPermission provides the underlying (recursive) functionality of
+// HasPermission, the caller must hold the lock.
+func (p *Policy) hasPermission(role Role, permission Permission, visited map[Role]bool) bool {
+	rp, ok := p.roles[role]
+	if !ok || visited[role] {
+		return false
+	}
+	visited[role] = true
+
+	if rp.permissions[permission] || rp.permissions[AllPermissions] {
+		return true
+	}
+
+	for _, parent := range rp.parents {
+		if p.hasPermission(parent, permission, visited) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scope returns the widest scope of role and its parents, the
+// caller must hold the lock.
+func (p *Policy) scope(role Role, visited map[Role]bool) Scope {
+	rp, ok := p.roles[role]
+	if !ok || visited[role] {
+		return ScopePublic
+	}
+	visited[role] = true
+
+	scope := rp.scope
+	for _, parent := range rp.parents {
+		if parentScope := p.scope(parent, visited); parentScope > scope {
+			scope = parentScope
+		}
+	}
+
+	return scope
+}
+
+// inherits reports whether role inherits from ancestor, the caller
+// must hold the lock.
+func (p *Policy) inherits(role, ancestor Role, visited map[Role]bool) bool {
+	if role == ancestor {
+		return true
+	}
+
+	rp, ok := p.roles[role]
+	if !ok || visited[role] {
+		return false
+	}
+	visited[role] = true
+
+	for _, parent := range rp.parents {
+		if p.inherits(parent, ancestor, visited) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,57 @@
+package token
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPolicyCanAccess(t *testing.T) {
+	const readReports Permission = "reports:read"
+	const deleteOrg Permission = "org:delete"
+
+	policy := DefaultPolicy()
+	policy.Grant(OrgUser, readReports)
+	policy.Grant(Vuer, readReports)
+
+	ownOrg := ResourceOwner{OrgID: "org-1"}
+	otherOrg := ResourceOwner{OrgID: "org-2"}
+	personal := ResourceOwner{Subject: "user@example.com"}
+	public := ResourceOwner{Public: true}
+
+	scenarios := map[string]struct {
+		Role       Role
+		Permission Permission
+		Owner      ResourceOwner
+		Allowed    bool
+	}{
+		"admin should access other orgs":           {Role: AdminUser, Permission: deleteOrg, Owner: otherOrg, Allowed: true},
+		"org user should access own org":           {Role: OrgUser, Permission: readReports, Owner: ownOrg, Allowed: true},
+		"org user should not access other orgs":    {Role: OrgUser, Permission: readReports, Owner: otherOrg, Allowed: false},
+		"org user should access public data":       {Role: OrgUser, Permission: readReports, Owner: public, Allowed: true},
+		"org user should need the permission":      {Role: OrgUser, Permission: deleteOrg, Owner: ownOrg, Allowed: false},
+		"service user should inherit org user":     {Role: ServiceUser, Permission: readReports, Owner: ownOrg, Allowed: true},
+		"vuer should access personal data":         {Role: Vuer, Permission: readReports, Owner: personal, Allowed: true},
+		"vuer should not access org data":          {Role: Vuer, Permission: readReports, Owner: ownOrg, Allowed: false},
+		"unknown roles should not access anything": {Role: "unknown", Permission: readReports, Owner: public, Allowed: false},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			authToken := newTestAuthToken()
+			authToken.Role = scene.Role
+			authToken.OrgID = "org-1"
+
+			ctx := WithAuthToken(context.Background(), authToken)
+			if allowed := policy.CanAccess(ctx, scene.Permission, scene.Owner); allowed != scene.Allowed {
+				t.Errorf("expected '%v' but got '%v'", scene.Allowed, allowed)
+			}
+		})
+	}
+}
+
+func TestPolicyInheritanceCycle(t *testing.T) {
+	policy := DefaultPolicy()
+	if err := policy.Inherit(OrgUser, ServiceUser); err == nil {
+		t.Error("expected inheritance cycle to be rejected")
+	}
+}
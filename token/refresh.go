@@ -0,0 +1,340 @@
+package token
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+
+	"github.com/cosmotek/api-commons/database"
+)
+
+var (
+	// ErrRefreshTokenInvalid is returned by Refresher.Refresh when the
+	// refresh token does not exist.
+	ErrRefreshTokenInvalid = errors.New("user error: failed to refresh, refresh token invalid")
+
+	// ErrRefreshTokenExpired is returned by Refresher.Refresh when the
+	// refresh token has expired. The user must log in again.
+	ErrRefreshTokenExpired = errors.New("user error: failed to refresh, refresh token has expired")
+
+	// ErrRefreshTokenReused is returned by Refresher.Refresh when a refresh
+	// token that has already been rotated is presented again. This indicates
+	// the token has likely been stolen, so the entire token family is
+	// deactivated when this error is returned.
+	ErrRefreshTokenReused = errors.New("user error: failed to refresh, refresh token has already been used")
+
+	// ErrTokenDeactivated is returned when a token has been deactivated
+	// (see RecordTokenActivationStatusChange).
+	ErrTokenDeactivated = errors.New("user error: failed to authenticate, token has been deactivated")
+
+	// ErrRefreshLimitReached is returned by Refresher.Refresh when the token
+	// has already been refreshed RefresherConfig.MaxRefreshes times.
+	ErrRefreshLimitReached = errors.New("user error: failed to refresh, refresh limit reached")
+)
+
+// RefresherConfig configures the lifetime of the tokens issued by a Refresher.
+type RefresherConfig struct {
+	// Signer is used to sign access tokens.
+	Signer Signer
+
+	// TokenTTL is the lifetime of each access token.
+	TokenTTL time.Duration
+
+	// RefreshTokenTTL is the lifetime of each refresh token. Refresh tokens
+	// are rotated on every use, so this is effectively the maximum idle time
+	// of a session.
+	RefreshTokenTTL time.Duration
+
+	// MaxRefreshes is the number of times a token family may be refreshed
+	// before the user must log in again, zero allows unlimited refreshes.
+	MaxRefreshes uint64
+}
+
+// TokenPair is a signed access token and the opaque refresh token which
+// may be used to renew it.
+type TokenPair struct {
+	AuthToken    AuthToken
+	AccessToken  string
+	RefreshToken string
+}
+
+// refreshToken is used internally to store and retrieve refresh tokens
+// from the jwt_refresh_tokens table.
+type refreshToken struct {
+	TokenHash string    `db:"token_hash"`
+	TokenID   string    `db:"jti"`
+	ExpiresAt time.Time `db:"expires_at"`
+	Consumed  bool      `db:"consumed"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// Refresher issues access tokens along with opaque refresh tokens tied to the
+// access token's jti (the token family), rotating the refresh token on every
+// use and deactivating the family when a rotated refresh token is reused.
+type Refresher struct {
+	db   *database.DB
+	conf RefresherConfig
+}
+
+// NewRefresher creates a Refresher using the provided database and config.
+func NewRefresher(db *database.DB, conf RefresherConfig) *Refresher {
+	return &Refresher{
+		db:   db,
+		conf: conf,
+	}
+}
+
+// Issue signs an access token for authToken, records it in jwt_tokens and
+// creates its first refresh token. ID, IssuedAt, NotBefore and ExpiresAt are
+// populated using the Refresher config when left empty, and TokenVersion is
+// populated using CurrentTokenVersion.
+func (r *Refresher) Issue(authToken AuthToken) (TokenPair, error) {
+	return r.IssueContext(context.Background(), authToken)
+}
+
+// IssueContext is Issue using the provided context.
+func (r *Refresher) IssueContext(ctx context.Context, authToken AuthToken) (TokenPair, error) {
+	var tokenPair TokenPair
+	err := r.db.Update(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		tokenPair, err = r.IssueTx(tx, authToken)
+		return err
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return tokenPair, nil
+}
+
+// IssueTx is Issue using an existing transaction, allowing a token to be
+// issued atomically with the caller's own rows.
+func (r *Refresher) IssueTx(tx *sqlx.Tx, authToken AuthToken) (TokenPair, error) {
+	now := time.Now().UTC()
+	if authToken.ID == "" {
+		authToken.ID = uuid.New().String()
+	}
+
+	if authToken.IssuedAt.IsZero() {
+		authToken.IssuedAt = now
+	}
+
+	if authToken.NotBefore.IsZero() {
+		authToken.NotBefore = now
+	}
+
+	if authToken.ExpiresAt.IsZero() {
+		authToken.ExpiresAt = now.Add(r.conf.TokenTTL)
+	}
+
+	if authToken.TokenVersion == 0 {
+		version, err := CurrentTokenVersionTx(tx, authToken.Subject)
+		if err != nil {
+			return TokenPair{}, err
+		}
+
+		authToken.TokenVersion = version
+	}
+
+	accessToken, err := r.conf.Signer.Sign(authToken)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	err = RecordTokenCreateTx(tx, authToken)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	refreshTokenStr, err := r.createRefreshToken(tx, authToken.ID, now)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		AuthToken:    authToken,
+		AccessToken:  accessToken,
+		RefreshToken: refreshTokenStr,
+	}, nil
+}
+
+// Refresh consumes the provided refresh token, returning a freshly signed
+// access token (with an incremented RefreshCount) and a new refresh token.
+// If the refresh token has already been consumed, the whole token family
+// is deactivated and ErrRefreshTokenReused is returned. Tokens whose version
+// has since been bumped (see BumpTokenVersion) are not refreshed.
+func (r *Refresher) Refresh(refreshTokenStr string) (TokenPair, error) {
+	return r.RefreshContext(context.Background(), refreshTokenStr)
+}
+
+// RefreshContext is Refresh using the provided context.
+func (r *Refresher) RefreshContext(ctx context.Context, refreshTokenStr string) (TokenPair, error) {
+	now := time.Now().UTC()
+	reused := false
+
+	var authToken AuthToken
+	var newRefreshTokenStr string
+	err := r.db.Update(ctx, func(tx *sqlx.Tx) error {
+		current := refreshToken{}
+		err := tx.Get(&current, `
+		SELECT * FROM jwt_refresh_tokens r
+		WHERE r.token_hash = $1
+		LIMIT 1
+		FOR UPDATE;
+		`, hashRefreshToken(refreshTokenStr))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrRefreshTokenInvalid
+			}
+
+			return err
+		}
+
+		if current.Consumed {
+			// the transaction must commit for the deactivation to stick,
+			// so the error is returned once the update has completed
+			reused = true
+			return deactivateTokenFamily(tx, current.TokenID)
+		}
+
+		if current.ExpiresAt.Before(now) {
+			return ErrRefreshTokenExpired
+		}
+
+		err = tx.Get(&authToken, `SELECT `+authTokenColumns+` FROM jwt_tokens WHERE jti = $1 LIMIT 1 FOR UPDATE`, current.TokenID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrRefreshTokenInvalid
+			}
+
+			return err
+		}
+
+		if authToken.Deactivated {
+			return ErrTokenDeactivated
+		}
+
+		if r.conf.MaxRefreshes > 0 && authToken.RefreshCount >= r.conf.MaxRefreshes {
+			return ErrRefreshLimitReached
+		}
+
+		minVersion, err := CurrentTokenVersionTx(tx, authToken.Subject)
+		if err != nil {
+			return err
+		}
+
+		if authToken.TokenVersion < minVersion {
+			return ErrTokenOutdated
+		}
+
+		_, err = tx.Exec(`UPDATE jwt_refresh_tokens SET consumed = TRUE WHERE token_hash = $1`, current.TokenHash)
+		if err != nil {
+			return err
+		}
+
+		authToken.IssuedAt = now
+		authToken.NotBefore = now
+		authToken.ExpiresAt = now.Add(r.conf.TokenTTL)
+		authToken.RefreshCount++
+
+		// the record must match the token being signed, for session listings
+		// and for verifiers comparing the issue time
+		_, err = tx.Exec(`
+		UPDATE jwt_tokens SET
+			refresh_count = $2,
+			issued_at = $3,
+			not_before = $4,
+			expires_at = $5
+		WHERE jti = $1;
+		`, authToken.ID, authToken.RefreshCount, authToken.IssuedAt, authToken.NotBefore, authToken.ExpiresAt)
+		if err != nil {
+			return err
+		}
+
+		newRefreshTokenStr, err = r.createRefreshToken(tx, authToken.ID, now)
+		return err
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	if reused {
+		return TokenPair{}, ErrRefreshTokenReused
+	}
+
+	accessToken, err := r.conf.Signer.Sign(authToken)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		AuthToken:    authToken,
+		AccessToken:  accessToken,
+		RefreshToken: newRefreshTokenStr,
+	}, nil
+}
+
+// createRefreshToken generates a refresh token for the token family
+// identified by jti, storing only its hash.
+func (r *Refresher) createRefreshToken(tx *sqlx.Tx, jti string, now time.Time) (string, error) {
+	buff := make([]byte, 32)
+	_, err := rand.Read(buff)
+	if err != nil {
+		return "", err
+	}
+
+	refreshTokenStr := base64.RawURLEncoding.EncodeToString(buff)
+	_, err = tx.NamedExec(`
+	INSERT INTO jwt_refresh_tokens (
+		token_hash,
+		jti,
+		expires_at,
+		consumed,
+		created_at
+	) VALUES (
+		:token_hash,
+		:jti,
+		:expires_at,
+		:consumed,
+		:created_at
+	);
+	`, refreshToken{
+		TokenHash: hashRefreshToken(refreshTokenStr),
+		TokenID:   jti,
+		ExpiresAt: now.Add(r.conf.RefreshTokenTTL),
+		CreatedAt: now,
+	})
+
+	return refreshTokenStr, err
+}
+
+// deactivateTokenFamily deactivates the token identified by jti and consumes
+// every refresh token issued for it.
+func deactivateTokenFamily(tx *sqlx.Tx, jti string) error {
+	_, err := tx.Exec(`UPDATE jwt_tokens SET deactivated = TRUE WHERE jti = $1`, jti)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE jwt_refresh_tokens SET consumed = TRUE WHERE jti = $1`, jti)
+	if err != nil {
+		return err
+	}
+
+	return notifyRevocation(tx, "jti:"+jti)
+}
+
+// hashRefreshToken returns the hex encoded sha256 hash of a refresh token.
+// Refresh tokens contain 256 bits of entropy, so a fast hash is sufficient.
+func hashRefreshToken(refreshTokenStr string) string {
+	sum := sha256.Sum256([]byte(refreshTokenStr))
+	return hex.EncodeToString(sum[:])
+}
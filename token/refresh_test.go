@@ -0,0 +1,237 @@
+package token
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/cosmotek/api-commons/database"
+)
+
+// testDatabase connects to the postgres database described by the
+// POSTGRES_* environment variables, skipping the test when POSTGRES_HOST
+// is not set.
+func testDatabase(t *testing.T) *database.DB {
+	host := os.Getenv("POSTGRES_HOST")
+	if host == "" {
+		t.Skip("POSTGRES_HOST not set, skipping database test")
+	}
+
+	port := os.Getenv("POSTGRES_PORT")
+	if port == "" {
+		port = "5432"
+	}
+
+	db, err := database.Dial(database.Config{
+		User:         os.Getenv("POSTGRES_USER"),
+		Password:     os.Getenv("POSTGRES_PASSWORD"),
+		Host:         host,
+		Port:         port,
+		DatabaseName: os.Getenv("POSTGRES_DB"),
+		SSLDisabled:  os.Getenv("POSTGRES_SSL") != "true",
+		Migrations:   []database.MigrationSource{Migrations},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	_, err = db.SyncMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// testRefresher returns a Refresher signing with a fresh rsa key.
+func testRefresher(t *testing.T, db *database.DB, conf RefresherConfig) *Refresher {
+	signer, err := NewSigningKey("kid", newTestRSAKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf.Signer = signer
+	if conf.TokenTTL == 0 {
+		conf.TokenTTL = time.Minute
+	}
+
+	if conf.RefreshTokenTTL == 0 {
+		conf.RefreshTokenTTL = time.Hour
+	}
+
+	return NewRefresher(db, conf)
+}
+
+// testSubjectToken returns an AuthToken for a unique subject, so that
+// database tests do not interfere with each other.
+func testSubjectToken() AuthToken {
+	return AuthToken{
+		Role:        OrgUser,
+		Audience:    "test",
+		Subject:     "test-" + uuid.New().String(),
+		SubjectType: Email,
+	}
+}
+
+// isDeactivated returns the deactivated status of the token identified by jti.
+func isDeactivated(t *testing.T, db *database.DB, jti string) bool {
+	var deactivated bool
+	err := db.DB.Get(&deactivated, `SELECT deactivated FROM jwt_tokens WHERE jti = $1`, jti)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return deactivated
+}
+
+func TestRefresherRotation(t *testing.T) {
+	db := testDatabase(t)
+	refresher := testRefresher(t, db, RefresherConfig{})
+
+	issued, err := refresher.Issue(testSubjectToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if issued.AuthToken.TokenVersion != 1 {
+		t.Errorf("expected token version 1, got %d", issued.AuthToken.TokenVersion)
+	}
+
+	refreshed, err := refresher.Refresh(issued.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if refreshed.RefreshToken == issued.RefreshToken {
+		t.Error("expected the refresh token to be rotated")
+	}
+
+	if refreshed.AuthToken.ID != issued.AuthToken.ID || refreshed.AuthToken.RefreshCount != 1 {
+		t.Errorf("expected the same token family with refresh count 1, got %+v", refreshed.AuthToken)
+	}
+
+	var recorded AuthToken
+	err = db.DB.Get(&recorded, `SELECT `+authTokenColumns+` FROM jwt_tokens WHERE jti = $1`, issued.AuthToken.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !recorded.IssuedAt.Equal(refreshed.AuthToken.IssuedAt.Truncate(time.Microsecond)) ||
+		!recorded.NotBefore.Equal(refreshed.AuthToken.NotBefore.Truncate(time.Microsecond)) {
+		t.Errorf("expected the recorded issue times to match the refreshed token, got %+v", recorded)
+	}
+
+	_, err = refresher.Refresh(refreshed.RefreshToken)
+	if err != nil {
+		t.Fatalf("expected the rotated refresh token to be accepted, got %v", err)
+	}
+}
+
+func TestRefresherReuseDeactivatesFamily(t *testing.T) {
+	db := testDatabase(t)
+	refresher := testRefresher(t, db, RefresherConfig{})
+
+	issued, err := refresher.Issue(testSubjectToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed, err := refresher.Refresh(issued.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// presenting the consumed refresh token again deactivates the family
+	_, err = refresher.Refresh(issued.RefreshToken)
+	if err != ErrRefreshTokenReused {
+		t.Fatalf("expected ErrRefreshTokenReused, got %v", err)
+	}
+
+	if !isDeactivated(t, db, issued.AuthToken.ID) {
+		t.Error("expected the token family to be deactivated")
+	}
+
+	_, err = refresher.Refresh(refreshed.RefreshToken)
+	if err != ErrRefreshTokenReused {
+		t.Errorf("expected the latest refresh token to be consumed, got %v", err)
+	}
+}
+
+func TestRefresherErrors(t *testing.T) {
+	db := testDatabase(t)
+
+	scenarios := map[string]struct {
+		Config  RefresherConfig
+		Prepare func(t *testing.T, refresher *Refresher, pair TokenPair) string
+		Error   error
+	}{
+		"should reject unknown refresh tokens": {
+			Prepare: func(t *testing.T, refresher *Refresher, pair TokenPair) string {
+				return "unknown"
+			},
+			Error: ErrRefreshTokenInvalid,
+		},
+		"should reject expired refresh tokens": {
+			Config: RefresherConfig{RefreshTokenTTL: -time.Minute},
+			Prepare: func(t *testing.T, refresher *Refresher, pair TokenPair) string {
+				return pair.RefreshToken
+			},
+			Error: ErrRefreshTokenExpired,
+		},
+		"should reject deactivated tokens": {
+			Prepare: func(t *testing.T, refresher *Refresher, pair TokenPair) string {
+				err := RecordTokenActivationStatusChange(db, pair.AuthToken.Subject, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return pair.RefreshToken
+			},
+			Error: ErrTokenDeactivated,
+		},
+		"should stop at the refresh limit": {
+			Config: RefresherConfig{MaxRefreshes: 1},
+			Prepare: func(t *testing.T, refresher *Refresher, pair TokenPair) string {
+				refreshed, err := refresher.Refresh(pair.RefreshToken)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return refreshed.RefreshToken
+			},
+			Error: ErrRefreshLimitReached,
+		},
+		"should reject outdated token versions": {
+			Prepare: func(t *testing.T, refresher *Refresher, pair TokenPair) string {
+				_, err := BumpTokenVersion(db, pair.AuthToken.Subject)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return pair.RefreshToken
+			},
+			Error: ErrTokenOutdated,
+		},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			refresher := testRefresher(t, db, scene.Config)
+			pair, err := refresher.Issue(testSubjectToken())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = refresher.Refresh(scene.Prepare(t, refresher, pair))
+			if err != scene.Error {
+				t.Fatalf("expected %v, got %v", scene.Error, err)
+			}
+		})
+	}
+}
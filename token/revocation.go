@@ -0,0 +1,224 @@
+package token
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"github.com/cosmotek/api-commons/database"
+)
+
+// RevocationChannel is the postgres notification channel on which token
+// activation status changes are published. Payloads are either
+// "jti:<token id>" or "sub:<subject>", or "tver:<subject>" when the
+// minimum token version of a subject (or "*") changes.
+const RevocationChannel = "jwt_tokens_revocations"
+
+// ErrTokenUnknown is returned by a RevocationVerifier when a token has no
+// jwt_tokens record and RevocationConfig.AllowUnknown is not set.
+var ErrTokenUnknown = errors.New("user error: failed to authenticate, token not recognized")
+
+// RevocationConfig configures the caching behaviour of a RevocationVerifier.
+type RevocationConfig struct {
+	// CacheSize is the maximum number of token statuses held in memory,
+	// defaults to 10000.
+	CacheSize int
+
+	// CacheTTL is how long a token status is cached before the database is
+	// consulted again, defaults to 30 seconds. When Listen is running,
+	// revocations take effect immediately regardless of the TTL.
+	CacheTTL time.Duration
+
+	// AllowUnknown accepts tokens that have no jwt_tokens record (such as
+	// tokens issued without calling RecordTokenCreate).
+	AllowUnknown bool
+}
+
+// revocationStatus is the cached jwt_tokens state of a single token.
+type revocationStatus struct {
+	Subject     string `db:"subject"`
+	Deactivated bool   `db:"deactivated"`
+	Exists      bool   `db:"-"`
+}
+
+// RevocationVerifier wraps a Verifier, additionally checking the jti of each
+// valid token against the jwt_tokens table so deactivated tokens are rejected
+// before they expire. Token statuses are cached in-process, and the cache may
+// be invalidated by postgres notifications (see Listen).
+type RevocationVerifier struct {
+	Verifier
+	db    *database.DB
+	conf  RevocationConfig
+	cache *ttlCache
+}
+
+// NewRevocationVerifier creates a RevocationVerifier wrapping verifier.
+func NewRevocationVerifier(verifier Verifier, db *database.DB, conf RevocationConfig) *RevocationVerifier {
+	if conf.CacheSize <= 0 {
+		conf.CacheSize = 10000
+	}
+
+	if conf.CacheTTL <= 0 {
+		conf.CacheTTL = time.Second * 30
+	}
+
+	return &RevocationVerifier{
+		Verifier: verifier,
+		db:       db,
+		conf:     conf,
+		cache:    newTTLCache(conf.CacheSize, conf.CacheTTL),
+	}
+}
+
+// Verify validates the token using the wrapped Verifier, returning
+// ErrTokenDeactivated if the token has since been deactivated.
+func (v *RevocationVerifier) Verify(inputStr string) (AuthToken, error) {
+	return v.VerifyContext(context.Background(), inputStr)
+}
+
+// VerifyContext is Verify using the provided context.
+func (v *RevocationVerifier) VerifyContext(ctx context.Context, inputStr string) (AuthToken, error) {
+	return v.verify(ctx, inputStr, false)
+}
+
+// VerifyIgnoringExpiry validates the token (ignoring expiry) using the wrapped
+// Verifier, returning ErrTokenDeactivated if the token has been deactivated.
+func (v *RevocationVerifier) VerifyIgnoringExpiry(inputStr string) (AuthToken, error) {
+	return v.VerifyIgnoringExpiryContext(context.Background(), inputStr)
+}
+
+// VerifyIgnoringExpiryContext is VerifyIgnoringExpiry using the provided context.
+func (v *RevocationVerifier) VerifyIgnoringExpiryContext(ctx context.Context, inputStr string) (AuthToken, error) {
+	return v.verify(ctx, inputStr, true)
+}
+
+// verify provides the underlying functionality for the Verify methods.
+func (v *RevocationVerifier) verify(ctx context.Context, inputStr string, ignoreExpiry bool) (AuthToken, error) {
+	authToken, err := verifyContext(ctx, v.Verifier, inputStr, ignoreExpiry)
+	if err != nil {
+		return AuthToken{}, err
+	}
+
+	return authToken, v.check(ctx, authToken.ID)
+}
+
+// check returns an error if the token identified by jti has been
+// deactivated (or is unknown).
+func (v *RevocationVerifier) check(ctx context.Context, jti string) error {
+	status, err := v.status(ctx, jti)
+	if err != nil {
+		return err
+	}
+
+	if !status.Exists && !v.conf.AllowUnknown {
+		return ErrTokenUnknown
+	}
+
+	if status.Deactivated {
+		return ErrTokenDeactivated
+	}
+
+	return nil
+}
+
+// status returns the (possibly cached) status of the token identified by jti.
+func (v *RevocationVerifier) status(ctx context.Context, jti string) (revocationStatus, error) {
+	if cached, ok := v.cache.get(jti); ok {
+		return cached.(revocationStatus), nil
+	}
+
+	// a notification handled while the status is read invalidates the read,
+	// so it must not be cached
+	generation := v.cache.generation()
+	status := revocationStatus{}
+	err := v.db.View(ctx, func(tx *sqlx.Tx) error {
+		return tx.Get(&status, `SELECT t.subject, t.deactivated FROM jwt_tokens t WHERE t.jti = $1 LIMIT 1`, jti)
+	})
+	if err != nil && err != sql.ErrNoRows {
+		return revocationStatus{}, err
+	}
+
+	status.Exists = err == nil
+	v.cache.setIfGeneration(jti, status, generation)
+	return status, nil
+}
+
+// Invalidate removes the cached status of the token identified by jti.
+func (v *RevocationVerifier) Invalidate(jti string) {
+	v.cache.delete(jti)
+}
+
+// InvalidateSubject removes the cached status of every token issued to subject.
+func (v *RevocationVerifier) InvalidateSubject(subject string) {
+	v.cache.deleteFunc(func(key string, value interface{}) bool {
+		return value.(revocationStatus).Subject == subject
+	})
+}
+
+// Listen subscribes to RevocationChannel using a dedicated connection,
+// invalidating cached token statuses as notifications arrive, so that
+// deactivation takes effect within moments across every process. Listen
+// blocks until ctx is cancelled.
+func (v *RevocationVerifier) Listen(ctx context.Context, conf database.Config) error {
+	return listenRevocations(ctx, conf, v.handleNotification, v.cache.purge)
+}
+
+// listenRevocations subscribes to RevocationChannel using a dedicated
+// connection, passing each notification payload to handle until ctx is
+// cancelled. reset is called when the connection is re-established, as
+// notifications may have been missed.
+func listenRevocations(ctx context.Context, conf database.Config, handle func(payload string), reset func()) error {
+	listener := pq.NewListener(conf.ConnectionString(), time.Second, time.Minute, nil)
+	defer listener.Close()
+
+	err := listener.Listen(RevocationChannel)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case notification := <-listener.Notify:
+			if notification == nil {
+				reset()
+				continue
+			}
+
+			handle(notification.Extra)
+		case <-ticker.C:
+			go listener.Ping()
+		}
+	}
+}
+
+// handleNotification invalidates the cache entries described by a
+// RevocationChannel payload.
+func (v *RevocationVerifier) handleNotification(payload string) {
+	switch {
+	case strings.HasPrefix(payload, "jti:"):
+		v.Invalidate(strings.TrimPrefix(payload, "jti:"))
+	case strings.HasPrefix(payload, "sub:"):
+		v.InvalidateSubject(strings.TrimPrefix(payload, "sub:"))
+	case strings.HasPrefix(payload, "tver:"):
+		// token versions are enforced by TokenVersionVerifier
+	default:
+		v.cache.purge()
+	}
+}
+
+// notifyRevocation publishes a RevocationChannel notification using tx,
+// the notification is delivered once the transaction commits.
+func notifyRevocation(tx *sqlx.Tx, payload string) error {
+	_, err := tx.Exec(`SELECT pg_notify($1, $2)`, RevocationChannel, payload)
+	return err
+}
@@ -0,0 +1,208 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/cosmotek/api-commons/database"
+)
+
+// activeSessionCondition matches jwt_tokens records which are still usable,
+// either because the access token has not expired or because it may still
+// be renewed using an unexpired refresh token. $1 is the current time.
+const activeSessionCondition = `
+	NOT t.deactivated AND (
+		t.expires_at > $1 OR EXISTS (
+			SELECT 1 FROM jwt_refresh_tokens r
+			WHERE r.jti = t.jti AND NOT r.consumed AND r.expires_at > $1
+		)
+	)
+`
+
+// DefaultPurgeBatchSize is the batch size used by PurgeExpiredSessions when
+// batchSize is not positive.
+const DefaultPurgeBatchSize = 1000
+
+// WithRequestMetadata returns authToken with the user agent and client IP
+// address of req attached, for display in session listings. The first
+// X-Forwarded-For address is preferred when present, so this should only be
+// used behind a proxy which sets (or strips) the header.
+func WithRequestMetadata(authToken AuthToken, req *http.Request) AuthToken {
+	authToken.UserAgent = req.UserAgent()
+
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		authToken.IPAddress = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		return authToken
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	authToken.IPAddress = host
+	return authToken
+}
+
+// ListSessions returns the active sessions (jwt_tokens records) of
+// subject, most recently issued first.
+func ListSessions(db *database.DB, subject string) ([]AuthToken, error) {
+	return ListSessionsContext(context.Background(), db, subject)
+}
+
+// ListSessionsContext is ListSessions using the provided context.
+func ListSessionsContext(ctx context.Context, db *database.DB, subject string) ([]AuthToken, error) {
+	queryStr := `
+	SELECT ` + authTokenColumns + ` FROM jwt_tokens t
+	WHERE
+		t.subject = $2 AND
+	` + activeSessionCondition + `
+	ORDER BY t.issued_at DESC;
+	`
+
+	sessions := []AuthToken{}
+	err := db.View(ctx, func(tx *sqlx.Tx) error {
+		return tx.Select(&sessions, queryStr, time.Now().UTC(), subject)
+	})
+
+	return sessions, err
+}
+
+// ErrSessionNotFound is returned by RevokeSession when subject has no session
+// with the provided jti.
+var ErrSessionNotFound = errors.New("user error: session not found")
+
+// RevokeSession deactivates the session of subject identified by jti,
+// consuming its refresh tokens so that it cannot be renewed. Sessions of other
+// subjects are left untouched and ErrSessionNotFound is returned instead.
+func RevokeSession(db *database.DB, subject, jti string) error {
+	return RevokeSessionContext(context.Background(), db, subject, jti)
+}
+
+// RevokeSessionContext is RevokeSession using the provided context.
+func RevokeSessionContext(ctx context.Context, db *database.DB, subject, jti string) error {
+	return db.Update(ctx, func(tx *sqlx.Tx) error {
+		res, err := tx.Exec(`
+		UPDATE jwt_tokens SET deactivated = TRUE
+		WHERE jti = $1 AND subject = $2;
+		`, jti, subject)
+		if err != nil {
+			return err
+		}
+
+		updated, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if updated == 0 {
+			return ErrSessionNotFound
+		}
+
+		_, err = tx.Exec(`UPDATE jwt_refresh_tokens SET consumed = TRUE WHERE jti = $1`, jti)
+		if err != nil {
+			return err
+		}
+
+		return notifyRevocation(tx, "jti:"+jti)
+	})
+}
+
+// RevokeOtherSessions deactivates every session of subject except the session
+// identified by currentJTI (i.e. "log out everywhere else"), returning the
+// number of sessions revoked.
+func RevokeOtherSessions(db *database.DB, subject, currentJTI string) (int64, error) {
+	return RevokeOtherSessionsContext(context.Background(), db, subject, currentJTI)
+}
+
+// RevokeOtherSessionsContext is RevokeOtherSessions using the provided context.
+func RevokeOtherSessionsContext(ctx context.Context, db *database.DB, subject, currentJTI string) (int64, error) {
+	var revoked int64
+	err := db.Update(ctx, func(tx *sqlx.Tx) error {
+		res, err := tx.Exec(`
+		UPDATE jwt_tokens SET deactivated = TRUE
+		WHERE subject = $1 AND jti <> $2 AND NOT deactivated;
+		`, subject, currentJTI)
+		if err != nil {
+			return err
+		}
+
+		revoked, err = res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+		UPDATE jwt_refresh_tokens r SET consumed = TRUE
+		FROM jwt_tokens t
+		WHERE r.jti = t.jti AND t.subject = $1 AND t.jti <> $2;
+		`, subject, currentJTI)
+		if err != nil {
+			return err
+		}
+
+		return notifyRevocation(tx, "sub:"+subject)
+	})
+
+	return revoked, err
+}
+
+// PurgeExpiredSessions deletes jwt_tokens records (and their refresh tokens)
+// which expired before the provided time and can no longer be renewed. Rows
+// are deleted in batches of batchSize (DefaultPurgeBatchSize when zero or
+// negative), each in its own transaction, to avoid holding long locks on the
+// table. The total number of sessions deleted is returned.
+func PurgeExpiredSessions(db *database.DB, before time.Time, batchSize int) (int64, error) {
+	return PurgeExpiredSessionsContext(context.Background(), db, before, batchSize)
+}
+
+// PurgeExpiredSessionsContext is PurgeExpiredSessions using the provided context.
+func PurgeExpiredSessionsContext(ctx context.Context, db *database.DB, before time.Time, batchSize int) (int64, error) {
+	queryStr := `
+	WITH expired AS (
+		SELECT t.jti FROM jwt_tokens t
+		WHERE
+			t.expires_at < $1 AND
+			NOT EXISTS (
+				SELECT 1 FROM jwt_refresh_tokens r
+				WHERE r.jti = t.jti AND NOT r.consumed AND r.expires_at >= $1
+			)
+		LIMIT $2
+	), deleted_refresh_tokens AS (
+		DELETE FROM jwt_refresh_tokens r USING expired e WHERE r.jti = e.jti
+	)
+	DELETE FROM jwt_tokens t USING expired e WHERE t.jti = e.jti;
+	`
+
+	if batchSize <= 0 {
+		batchSize = DefaultPurgeBatchSize
+	}
+
+	var total int64
+	for {
+		var deleted int64
+		err := db.Update(ctx, func(tx *sqlx.Tx) error {
+			res, err := tx.Exec(queryStr, before, batchSize)
+			if err != nil {
+				return err
+			}
+
+			deleted, err = res.RowsAffected()
+			return err
+		})
+		if err != nil {
+			return total, err
+		}
+
+		total += deleted
+		if deleted < int64(batchSize) {
+			return total, nil
+		}
+	}
+}
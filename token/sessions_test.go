@@ -0,0 +1,124 @@
+package token
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListAndRevokeOtherSessions(t *testing.T) {
+	db := testDatabase(t)
+	refresher := testRefresher(t, db, RefresherConfig{})
+
+	authToken := testSubjectToken()
+	current, err := refresher.Issue(authToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := refresher.Issue(authToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a session of another subject must not be listed or revoked
+	unrelated, err := refresher.Issue(testSubjectToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := ListSessions(db, authToken.Subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(sessions))
+	}
+
+	revoked, err := RevokeOtherSessions(db, authToken.Subject, current.AuthToken.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if revoked != 1 {
+		t.Fatalf("expected 1 session to be revoked, got %d", revoked)
+	}
+
+	sessions, err = ListSessions(db, authToken.Subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 1 || sessions[0].ID != current.AuthToken.ID {
+		t.Fatalf("expected only the current session to remain, got %+v", sessions)
+	}
+
+	_, err = refresher.Refresh(other.RefreshToken)
+	if err != ErrRefreshTokenReused {
+		t.Errorf("expected the revoked session's refresh token to be consumed, got %v", err)
+	}
+
+	if isDeactivated(t, db, unrelated.AuthToken.ID) {
+		t.Error("expected sessions of other subjects to remain active")
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	db := testDatabase(t)
+	refresher := testRefresher(t, db, RefresherConfig{})
+
+	authToken := testSubjectToken()
+	session, err := refresher.Issue(authToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RevokeSession(db, testSubjectToken().Subject, session.AuthToken.ID)
+	if err != ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound when revoking another subject's session, got %v", err)
+	}
+
+	if isDeactivated(t, db, session.AuthToken.ID) {
+		t.Fatal("expected the session to remain active")
+	}
+
+	err = RevokeSession(db, authToken.Subject, session.AuthToken.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !isDeactivated(t, db, session.AuthToken.ID) {
+		t.Error("expected the session to be deactivated")
+	}
+
+	_, err = refresher.Refresh(session.RefreshToken)
+	if err != ErrRefreshTokenReused {
+		t.Errorf("expected the revoked session's refresh token to be consumed, got %v", err)
+	}
+}
+
+func TestPurgeExpiredSessions(t *testing.T) {
+	db := testDatabase(t)
+	refresher := testRefresher(t, db, RefresherConfig{TokenTTL: -time.Minute, RefreshTokenTTL: -time.Minute})
+
+	expired, err := refresher.Issue(testSubjectToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a zero batch size uses DefaultPurgeBatchSize rather than purging nothing
+	_, err = PurgeExpiredSessions(db, time.Now().UTC(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var remaining int
+	err = db.DB.Get(&remaining, `SELECT COUNT(*) FROM jwt_tokens WHERE jti = $1`, expired.AuthToken.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if remaining != 0 {
+		t.Error("expected the expired session to be purged")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rsa"
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
 	"time"
 
@@ -23,6 +24,10 @@ var (
 	// be allowed to refresh/renew.
 	ErrTokenExpired  = errors.New("user error: failed to authenticate, token has expired")
 	ErrTokenOutdated = errors.New("user error: failed to authenticate, token is outdated")
+
+	// ErrUnknownKey is returned by KeyRing verification when a token
+	// carries a kid header that does not match any key in the ring.
+	ErrUnknownKey = errors.New("user error: failed to authenticate, token signed by unknown key")
 )
 
 // Role is a system identifier used to determine permissions that
@@ -62,8 +67,14 @@ type AuthToken struct {
 	TokenVersion int         `json:"tver" mapstructure:"tver" db:"token_version"`
 	Role         Role        `json:"role" mapstructure:"role" db:"role"`
 	Audience     string      `json:"aud" mapstructure:"aud" db:"audience"`
+	Issuer       string      `json:"iss,omitempty" mapstructure:"iss" db:"issuer"`
 	Subject      string      `json:"sub,omitempty" mapstructure:"sub" db:"subject"`
 	SubjectType  SubjectType `json:"subtyp,omitempty" mapstructure:"subtyp" db:"subject_type"`
+	OrgID        string      `json:"org,omitempty" mapstructure:"org" db:"org_id"`
+
+	// Claims holds any custom claims carried by the token,
+	// see the Claims type for typed accessors.
+	Claims Claims `json:"-" mapstructure:",remain" db:"claims"`
 
 	IssuedAt  time.Time `json:"iat" mapstructure:"iat" db:"issued_at"`
 	NotBefore time.Time `json:"nbf" mapstructure:"nbf" db:"not_before"`
@@ -71,6 +82,8 @@ type AuthToken struct {
 
 	RefreshCount uint64 `json:"-" mapstructure:"-" db:"refresh_count"`
 	Deactivated  bool   `json:"-" mapstructure:"-" db:"deactivated"`
+	UserAgent    string `json:"-" mapstructure:"-" db:"user_agent"`
+	IPAddress    string `json:"-" mapstructure:"-" db:"ip_address"`
 }
 
 // Verify takes in a JWT token string and rsaKey []byte and validates it.
@@ -79,49 +92,73 @@ type AuthToken struct {
 // If the token is valid, an AuthToken with the JWT token claims will be
 // returned.
 func Verify(inputStr string, rsaKey *rsa.PublicKey) (AuthToken, error) {
-	token, err := jwt.Parse(inputStr, func(token *jwt.Token) (interface{}, error) {
-		return rsaKey, nil
-	})
+	key := Key{method: jwt.SigningMethodRS256, public: rsaKey}
+	return verify(inputStr, key.keyFunc, ValidationConfig{}, false)
+}
 
+// VerifyIgnoringExpiry parses and returns the AuthToken (claims) for an expired token,
+// but only if the token is valid in all other ways.
+func VerifyIgnoringExpiry(inputStr string, rsaKey *rsa.PublicKey) (AuthToken, error) {
+	key := Key{method: jwt.SigningMethodRS256, public: rsaKey}
+	return verify(inputStr, key.keyFunc, ValidationConfig{}, true)
+}
+
+// DecodeUnverified decodes the AuthToken (claims) of a JWT token string
+// WITHOUT verifying its signature or validating its claims. It is intended
+// for debugging and introspection only, and must never be used to
+// authenticate a request.
+func DecodeUnverified(inputStr string) (AuthToken, error) {
+	token, _, err := new(jwt.Parser).ParseUnverified(inputStr, jwt.MapClaims{})
 	if err != nil {
-		validationErr, ok := err.(*jwt.ValidationError)
-		if !ok {
-			return AuthToken{}, fmt.Errorf("failed to decode, token invalid: %v", err)
-		}
+		return AuthToken{}, errors.New("failed to decode, token malformed")
+	}
 
-		if validationErr.Errors&jwt.ValidationErrorMalformed != 0 {
-			return AuthToken{}, errors.New("failed to decode, token malformed")
-		} else if validationErr.Errors&jwt.ValidationErrorNotValidYet != 0 {
-			return AuthToken{}, errors.New("failed to decode, token not active")
-		} else if validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
-			return AuthToken{}, errors.New("failed to decode, token signature invalid")
-		}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return AuthToken{}, errors.New("failed to decode, token claims malformed")
 	}
 
+	ValidationConfig{}.normalizeAudience(claims)
+
 	var t AuthToken
-	err = decode(token.Claims, &t)
-	if err != nil {
-		return AuthToken{}, err
-	}
+	err = decode(claims, &t)
+	return t, err
+}
 
-	if t.ExpiresAt.Before(time.Now().UTC()) {
-		return AuthToken{}, ErrTokenExpired
-	}
+// Sign creates and signs a JWT token using the provided AuthToken and rsaKey []byte slice,
+// returning the JWT token string or an error.
+func Sign(authToken AuthToken, rsaKey *rsa.PrivateKey) (string, error) {
+	return sign(authToken, jwt.SigningMethodRS256, "", rsaKey)
+}
 
-	if t.TokenVersion < 1 {
-		return AuthToken{}, ErrTokenOutdated
-	}
+// invalidTokenError wraps the reasons a token failed to decode, so that they
+// are told apart from failures unrelated to the token (see isAuthError).
+type invalidTokenError struct {
+	err error
+}
 
-	return t, nil
+// Error implements the error interface.
+func (e *invalidTokenError) Error() string {
+	return e.err.Error()
 }
 
-// VerifyIgnoringExpiry parses and returns the AuthToken (claims) for an expired token,
-// but only if the token is valid in all other ways.
-func VerifyIgnoringExpiry(inputStr string, rsaKey *rsa.PublicKey) (AuthToken, error) {
-	token, err := jwt.Parse(inputStr, func(token *jwt.Token) (interface{}, error) {
-		return rsaKey, nil
-	})
+// verify provides the underlying functionality for the Verify and VerifyIgnoringExpiry
+// functions (and their Key and KeyRing counterparts), using keyFunc to look up the key the
+// token signature is checked against and conf to validate the decoded claims.
+func verify(inputStr string, keyFunc jwt.Keyfunc, conf ValidationConfig, ignoreExpiry bool) (AuthToken, error) {
+	authToken, err := parseToken(inputStr, keyFunc, conf, ignoreExpiry)
+	if err != nil && !isAuthError(err) {
+		return authToken, &invalidTokenError{err: err}
+	}
+
+	return authToken, err
+}
 
+// parseToken decodes and validates a token for verify.
+func parseToken(inputStr string, keyFunc jwt.Keyfunc, conf ValidationConfig, ignoreExpiry bool) (AuthToken, error) {
+	// claim validation is handled below, once the claims have been decoded
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(inputStr, keyFunc)
 	if err != nil {
 		validationErr, ok := err.(*jwt.ValidationError)
 		if !ok {
@@ -130,48 +167,83 @@ func VerifyIgnoringExpiry(inputStr string, rsaKey *rsa.PublicKey) (AuthToken, er
 
 		if validationErr.Errors&jwt.ValidationErrorMalformed != 0 {
 			return AuthToken{}, errors.New("failed to decode, token malformed")
-		} else if validationErr.Errors&jwt.ValidationErrorNotValidYet != 0 {
-			return AuthToken{}, errors.New("failed to decode, token not active")
+		} else if validationErr.Errors&jwt.ValidationErrorUnverifiable != 0 {
+			if validationErr.Inner == ErrUnknownKey || validationErr.Inner == ErrAlgorithmMismatch {
+				return AuthToken{}, validationErr.Inner
+			}
+
+			return AuthToken{}, fmt.Errorf("failed to decode, token unverifiable: %v", validationErr.Inner)
 		} else if validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
 			return AuthToken{}, errors.New("failed to decode, token signature invalid")
 		}
+
+		return AuthToken{}, fmt.Errorf("failed to decode, token invalid: %v", err)
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return AuthToken{}, errors.New("failed to decode, token claims malformed")
+	}
+
+	if conf.RejectLegacyTimestamps && hasLegacyTimestamps(claims) {
+		return AuthToken{}, errors.New("failed to decode, token uses legacy timestamps")
 	}
 
+	conf.normalizeAudience(claims)
+
 	var t AuthToken
-	err = decode(token.Claims, &t)
+	err = decode(claims, &t)
 	if err != nil {
 		return AuthToken{}, err
 	}
 
-	if t.TokenVersion < 1 {
-		return AuthToken{}, ErrTokenOutdated
-	}
-
-	return t, nil
+	return t, conf.validate(t, ignoreExpiry)
 }
 
-// Sign creates and signs a JWT token using the provided AuthToken and rsaKey []byte slice,
-// returning the JWT token string or an error.
-func Sign(authToken AuthToken, rsaKey *rsa.PrivateKey) (string, error) {
-	token := jwt.New(jwt.SigningMethodRS256)
-	token.Claims = map[string]interface{}{
+// sign provides the underlying functionality for the Sign function and Key.Sign,
+// building the claim set from authToken and stamping the kid header when one is provided.
+func sign(authToken AuthToken, method jwt.SigningMethod, kid string, key interface{}) (string, error) {
+	claims := jwt.MapClaims{
 		"jti":    authToken.ID,
 		"role":   authToken.Role,
 		"aud":    authToken.Audience,
 		"sub":    authToken.Subject,
 		"subtyp": authToken.SubjectType,
-		"iat":    authToken.IssuedAt,
-		"nbf":    authToken.NotBefore,
-		"exp":    authToken.ExpiresAt,
 		"tver":   authToken.TokenVersion,
 	}
 
-	return token.SignedString(rsaKey)
+	setNumericDate(claims, "iat", authToken.IssuedAt)
+	setNumericDate(claims, "nbf", authToken.NotBefore)
+	setNumericDate(claims, "exp", authToken.ExpiresAt)
+
+	if authToken.Issuer != "" {
+		claims["iss"] = authToken.Issuer
+	}
+
+	if authToken.OrgID != "" {
+		claims["org"] = authToken.OrgID
+	}
+
+	for name, val := range authToken.Claims {
+		if registeredClaims[name] {
+			return "", fmt.Errorf("failed to sign token, custom claim '%s' conflicts with a registered claim", name)
+		}
+
+		claims[name] = val
+	}
+
+	token := jwt.NewWithClaims(method, claims)
+
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	return token.SignedString(key)
 }
 
-func RecordTokenCreate(db *database.DB, authToken AuthToken) error {
-	query := `
-INSERT INTO jwt_tokens (
+// authTokenColumns is the column list used when reading AuthTokens
+// from the jwt_tokens table.
+const authTokenColumns = `
 	jti,
 	token_version,
 	role,
@@ -182,8 +254,31 @@ INSERT INTO jwt_tokens (
 	not_before,
 	expires_at,
 	refresh_count,
-	deactivated
-) VALUES (
+	deactivated,
+	org_id,
+	claims,
+	issuer,
+	user_agent,
+	ip_address
+`
+
+// RecordTokenCreate inserts the jwt_tokens record for authToken.
+func RecordTokenCreate(db *database.DB, authToken AuthToken) error {
+	return RecordTokenCreateContext(context.Background(), db, authToken)
+}
+
+// RecordTokenCreateContext is RecordTokenCreate using the provided context.
+func RecordTokenCreateContext(ctx context.Context, db *database.DB, authToken AuthToken) error {
+	return db.Update(ctx, func(tx *sqlx.Tx) error {
+		return RecordTokenCreateTx(tx, authToken)
+	})
+}
+
+// RecordTokenCreateTx is RecordTokenCreate using an existing transaction,
+// allowing a token to be recorded atomically with the caller's own rows.
+func RecordTokenCreateTx(tx *sqlx.Tx, authToken AuthToken) error {
+	query := `
+INSERT INTO jwt_tokens (` + authTokenColumns + `) VALUES (
 	:jti,
 	:token_version,
 	:role,
@@ -194,31 +289,67 @@ INSERT INTO jwt_tokens (
 	:not_before,
 	:expires_at,
 	:refresh_count,
-	:deactivated
+	:deactivated,
+	:org_id,
+	:claims,
+	:issuer,
+	:user_agent,
+	:ip_address
 );
 	`
 
-	return db.Update(context.Background(), func(tx *sqlx.Tx) error {
-		_, err := tx.NamedExec(query, authToken)
-		return err
-	})
+	_, err := tx.NamedExec(query, authToken)
+	return err
 }
 
+// RecordTokenRefresh increments the refresh count and extends the expiry
+// of the jwt_tokens record identified by id.
 func RecordTokenRefresh(db *database.DB, id string, newExp time.Time) error {
-	return db.Update(context.Background(), func(tx *sqlx.Tx) error {
-		_, err := tx.Exec(`UPDATE jwt_tokens SET refresh_count = refresh_count + 1, expires_at = $2 WHERE jti = $1`, id, newExp)
-		return err
+	return RecordTokenRefreshContext(context.Background(), db, id, newExp)
+}
+
+// RecordTokenRefreshContext is RecordTokenRefresh using the provided context.
+func RecordTokenRefreshContext(ctx context.Context, db *database.DB, id string, newExp time.Time) error {
+	return db.Update(ctx, func(tx *sqlx.Tx) error {
+		return RecordTokenRefreshTx(tx, id, newExp)
 	})
 }
 
+// RecordTokenRefreshTx is RecordTokenRefresh using an existing transaction.
+func RecordTokenRefreshTx(tx *sqlx.Tx, id string, newExp time.Time) error {
+	_, err := tx.Exec(`UPDATE jwt_tokens SET refresh_count = refresh_count + 1, expires_at = $2 WHERE jti = $1`, id, newExp)
+	return err
+}
+
+// RecordTokenActivationStatusChange activates or deactivates every token
+// issued to subject, notifying RevocationVerifier listeners.
 func RecordTokenActivationStatusChange(db *database.DB, subject string, active bool) error {
-	return db.Update(context.Background(), func(tx *sqlx.Tx) error {
-		_, err := tx.Exec(`UPDATE jwt_tokens SET deactivated = $2 WHERE subject = $1`, subject, !active)
-		return err
+	return RecordTokenActivationStatusChangeContext(context.Background(), db, subject, active)
+}
+
+// RecordTokenActivationStatusChangeContext is RecordTokenActivationStatusChange
+// using the provided context.
+func RecordTokenActivationStatusChangeContext(ctx context.Context, db *database.DB, subject string, active bool) error {
+	return db.Update(ctx, func(tx *sqlx.Tx) error {
+		return RecordTokenActivationStatusChangeTx(tx, subject, active)
 	})
 }
 
-// toTimeHookFunc provides a time decoder for mapstructure decode calls
+// RecordTokenActivationStatusChangeTx is RecordTokenActivationStatusChange
+// using an existing transaction, the notification is delivered once the
+// transaction commits.
+func RecordTokenActivationStatusChangeTx(tx *sqlx.Tx, subject string, active bool) error {
+	_, err := tx.Exec(`UPDATE jwt_tokens SET deactivated = $2 WHERE subject = $1`, subject, !active)
+	if err != nil {
+		return err
+	}
+
+	return notifyRevocation(tx, "sub:"+subject)
+}
+
+// toTimeHookFunc provides a time decoder for mapstructure decode calls. Numeric
+// values are decoded as RFC 7519 NumericDate (seconds since the unix epoch),
+// strings are decoded as RFC3339 for tokens signed by older versions of Sign.
 func toTimeHookFunc() mapstructure.DecodeHookFunc {
 	return func(
 		f reflect.Type,
@@ -232,15 +363,38 @@ func toTimeHookFunc() mapstructure.DecodeHookFunc {
 		case reflect.String:
 			return time.Parse(time.RFC3339, data.(string))
 		case reflect.Float64:
-			return time.Unix(0, int64(data.(float64))*int64(time.Millisecond)), nil
+			sec, frac := math.Modf(data.(float64))
+			return time.Unix(int64(sec), int64(frac*float64(time.Second))).UTC(), nil
 		case reflect.Int64:
-			return time.Unix(0, data.(int64)*int64(time.Millisecond)), nil
+			return time.Unix(data.(int64), 0).UTC(), nil
+		case reflect.Int:
+			return time.Unix(int64(data.(int)), 0).UTC(), nil
 		default:
 			return data, nil
 		}
 	}
 }
 
+// setNumericDate sets the named claim to t as a RFC 7519 NumericDate
+// (seconds since the unix epoch), zero times are omitted from the token.
+func setNumericDate(claims jwt.MapClaims, name string, t time.Time) {
+	if !t.IsZero() {
+		claims[name] = t.Unix()
+	}
+}
+
+// hasLegacyTimestamps reports whether any of the time claims were
+// encoded as RFC3339 strings by an older version of Sign.
+func hasLegacyTimestamps(claims jwt.MapClaims) bool {
+	for _, name := range []string{"iat", "nbf", "exp"} {
+		if _, ok := claims[name].(string); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
 // decode wraps mapstructure.Decode to include the toTimeHookFunc for mapping
 // jwt token claims to an AuthToken.
 func decode(input map[string]interface{}, result interface{}) error {
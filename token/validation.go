@@ -0,0 +1,120 @@
+package token
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrInvalidAudience is returned when a token was not issued
+	// for any of the audiences accepted by the verifier.
+	ErrInvalidAudience = errors.New("user error: failed to authenticate, token audience not accepted")
+
+	// ErrInvalidIssuer is returned when a token was not issued
+	// by the issuer expected by the verifier.
+	ErrInvalidIssuer = errors.New("user error: failed to authenticate, token issuer not accepted")
+)
+
+// ValidationConfig configures the claim checks performed when verifying
+// tokens. The zero value performs the default checks with no leeway.
+type ValidationConfig struct {
+	// Leeway is the clock skew tolerated when checking the exp, nbf
+	// and iat claims.
+	Leeway time.Duration
+
+	// RejectLegacyTimestamps rejects tokens whose time claims are RFC3339
+	// strings (as signed by older versions of Sign) rather than NumericDate
+	// seconds. It should be enabled once every legacy token has expired.
+	RejectLegacyTimestamps bool
+
+	// Audiences lists the audiences accepted by the service, tokens whose
+	// aud claim does not match one of them are rejected with
+	// ErrInvalidAudience. No audience check is performed when empty.
+	Audiences []string
+
+	// Issuer is the expected iss claim, tokens issued by anyone else are
+	// rejected with ErrInvalidIssuer. No issuer check is performed when empty.
+	// Keys (and key rings) which sign tokens also stamp Issuer on tokens that
+	// do not already carry one.
+	Issuer string
+
+	// MinTokenVersion is the lowest accepted tver claim, tokens with an older
+	// version are rejected with ErrTokenOutdated. Defaults to 1. Versions
+	// stored in postgres (per subject or system-wide) are enforced by a
+	// TokenVersionVerifier.
+	MinTokenVersion int
+}
+
+// validate checks the time, version, audience and issuer claims of a decoded token.
+func (c ValidationConfig) validate(t AuthToken, ignoreExpiry bool) error {
+	now := time.Now().UTC()
+	if t.NotBefore.After(now.Add(c.Leeway)) {
+		return errors.New("failed to decode, token not active")
+	}
+
+	if t.IssuedAt.After(now.Add(c.Leeway)) {
+		return errors.New("failed to decode, token used before issued")
+	}
+
+	if !ignoreExpiry && t.ExpiresAt.Before(now.Add(-c.Leeway)) {
+		return ErrTokenExpired
+	}
+
+	if t.TokenVersion < c.minTokenVersion() {
+		return ErrTokenOutdated
+	}
+
+	if c.Issuer != "" && t.Issuer != c.Issuer {
+		return ErrInvalidIssuer
+	}
+
+	if len(c.Audiences) > 0 && !c.acceptsAudience(t.Audience) {
+		return ErrInvalidAudience
+	}
+
+	return nil
+}
+
+// minTokenVersion returns the configured minimum token version,
+// defaulting to 1.
+func (c ValidationConfig) minTokenVersion() int {
+	if c.MinTokenVersion < 1 {
+		return 1
+	}
+
+	return c.MinTokenVersion
+}
+
+// acceptsAudience reports whether audience is one of the accepted audiences.
+func (c ValidationConfig) acceptsAudience(audience string) bool {
+	for _, accepted := range c.Audiences {
+		if audience == accepted {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeAudience replaces an array aud claim (as permitted by RFC 7519)
+// with the first audience accepted by the config, or the first audience
+// listed when no audiences are configured.
+func (c ValidationConfig) normalizeAudience(claims map[string]interface{}) {
+	audiences, ok := claims["aud"].([]interface{})
+	if !ok {
+		return
+	}
+
+	delete(claims, "aud")
+	for _, aud := range audiences {
+		audience, ok := aud.(string)
+		if !ok {
+			continue
+		}
+
+		if len(c.Audiences) == 0 || c.acceptsAudience(audience) {
+			claims["aud"] = audience
+			return
+		}
+	}
+}
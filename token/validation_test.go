@@ -0,0 +1,218 @@
+package token
+
+import (
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+func TestNumericDateRoundTrip(t *testing.T) {
+	rsaKey := newTestRSAKey(t)
+	authToken := newTestAuthToken()
+
+	tokenStr, err := Sign(authToken, rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, _, err := new(jwt.Parser).ParseUnverified(tokenStr, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := parsed.Claims.(jwt.MapClaims)["exp"].(float64); !ok {
+		t.Errorf("expected exp to be encoded as a NumericDate")
+	}
+
+	verified, err := Verify(tokenStr, &rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verified.ExpiresAt.Unix() != authToken.ExpiresAt.Unix() {
+		t.Errorf("expected exp '%v' but got '%v'", authToken.ExpiresAt, verified.ExpiresAt)
+	}
+}
+
+func TestVerifyStandardAndLegacyTokens(t *testing.T) {
+	rsaKey := newTestRSAKey(t)
+	now := time.Now().UTC()
+
+	// tokens minted by standard jwt libraries use NumericDate seconds
+	standard, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"jti":  "standard",
+		"tver": 1,
+		"iat":  now.Unix(),
+		"exp":  now.Add(time.Hour).Unix(),
+	}).SignedString(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tokens minted by older versions of Sign used RFC3339 strings
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"jti":  "legacy",
+		"tver": 1,
+		"iat":  now.Format(time.RFC3339),
+		"exp":  now.Add(time.Hour).Format(time.RFC3339),
+	}).SignedString(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := NewVerificationKey("", &rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tokenStr := range []string{standard, legacy} {
+		if _, err := key.Verify(tokenStr); err != nil {
+			t.Errorf("expected token to verify but got '%v'", err)
+		}
+	}
+
+	key.SetValidationConfig(ValidationConfig{RejectLegacyTimestamps: true})
+	if _, err := key.Verify(standard); err != nil {
+		t.Errorf("expected standard token to verify but got '%v'", err)
+	}
+
+	if _, err := key.Verify(legacy); err == nil {
+		t.Error("expected legacy token to be rejected")
+	}
+}
+
+func TestValidationLeeway(t *testing.T) {
+	key, err := NewSigningKey("", newTestRSAKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authToken := newTestAuthToken()
+	authToken.ExpiresAt = time.Now().UTC().Add(-time.Second * 10)
+	tokenStr, err := key.Sign(authToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := key.Verify(tokenStr); err != ErrTokenExpired {
+		t.Errorf("expected '%v' but got '%v'", ErrTokenExpired, err)
+	}
+
+	key.SetValidationConfig(ValidationConfig{Leeway: time.Minute})
+	if _, err := key.Verify(tokenStr); err != nil {
+		t.Errorf("expected token within leeway to verify but got '%v'", err)
+	}
+}
+
+func TestValidationAudienceAndIssuer(t *testing.T) {
+	rsaKey := newTestRSAKey(t)
+	issuer, err := NewSigningKey("", rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.SetValidationConfig(ValidationConfig{Issuer: "https://auth.example.com"})
+
+	authToken := newTestAuthToken()
+	authToken.Audience = "dashboard"
+	tokenStr, err := issuer.Sign(authToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherIssuer, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"jti":  "other",
+		"tver": 1,
+		"iss":  "https://evil.example.com",
+		"aud":  []string{"billing", "dashboard"},
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	}).SignedString(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := map[string]struct {
+		Token  string
+		Config ValidationConfig
+		Err    error
+	}{
+		"should accept matching audience": {
+			Token:  tokenStr,
+			Config: ValidationConfig{Audiences: []string{"api", "dashboard"}, Issuer: "https://auth.example.com"},
+		},
+		"should reject other audiences": {
+			Token:  tokenStr,
+			Config: ValidationConfig{Audiences: []string{"api"}},
+			Err:    ErrInvalidAudience,
+		},
+		"should reject other issuers": {
+			Token:  otherIssuer,
+			Config: ValidationConfig{Issuer: "https://auth.example.com"},
+			Err:    ErrInvalidIssuer,
+		},
+		"should accept array audiences": {
+			Token:  otherIssuer,
+			Config: ValidationConfig{Audiences: []string{"dashboard"}},
+		},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			key, err := NewVerificationKey("", &rsaKey.PublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key.SetValidationConfig(scene.Config)
+
+			if _, err := key.Verify(scene.Token); err != scene.Err {
+				t.Errorf("expected '%v' but got '%v'", scene.Err, err)
+			}
+		})
+	}
+}
+
+func TestValidationMinTokenVersion(t *testing.T) {
+	key, err := NewSigningKey("", newTestRSAKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := map[string]struct {
+		TokenVersion    int
+		MinTokenVersion int
+		Err             error
+	}{
+		"should reject version 0 by default": {
+			TokenVersion: 0,
+			Err:          ErrTokenOutdated,
+		},
+		"should accept version 1 by default": {
+			TokenVersion: 1,
+		},
+		"should reject versions below the minimum": {
+			TokenVersion:    2,
+			MinTokenVersion: 3,
+			Err:             ErrTokenOutdated,
+		},
+		"should accept the minimum version": {
+			TokenVersion:    3,
+			MinTokenVersion: 3,
+		},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			authToken := newTestAuthToken()
+			authToken.TokenVersion = scene.TokenVersion
+			tokenStr, err := key.Sign(authToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			key.SetValidationConfig(ValidationConfig{MinTokenVersion: scene.MinTokenVersion})
+			if _, err := key.Verify(tokenStr); err != scene.Err {
+				t.Errorf("expected '%v' but got '%v'", scene.Err, err)
+			}
+		})
+	}
+}
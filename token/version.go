@@ -0,0 +1,228 @@
+package token
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/cosmotek/api-commons/database"
+)
+
+// AllSubjects is the jwt_token_versions subject used to store the
+// system-wide minimum token version.
+const AllSubjects = "*"
+
+// TokenVersionConfig configures the caching behaviour of a TokenVersionVerifier.
+type TokenVersionConfig struct {
+	// CacheSize is the maximum number of subject versions held in memory,
+	// defaults to 10000.
+	CacheSize int
+
+	// CacheTTL is how long a subject version is cached before the database
+	// is consulted again, defaults to 30 seconds. When Listen is running,
+	// version bumps take effect immediately regardless of the TTL.
+	CacheTTL time.Duration
+}
+
+// TokenVersionVerifier wraps a Verifier, additionally rejecting tokens whose
+// tver claim is below the minimum version stored in jwt_token_versions for
+// their subject (or for AllSubjects) with ErrTokenOutdated. Bumping a version
+// (see BumpTokenVersion) therefore forces a subject, or every subject, to
+// log in again.
+type TokenVersionVerifier struct {
+	Verifier
+	db    *database.DB
+	cache *ttlCache
+}
+
+// NewTokenVersionVerifier creates a TokenVersionVerifier wrapping verifier.
+func NewTokenVersionVerifier(verifier Verifier, db *database.DB, conf TokenVersionConfig) *TokenVersionVerifier {
+	if conf.CacheSize <= 0 {
+		conf.CacheSize = 10000
+	}
+
+	if conf.CacheTTL <= 0 {
+		conf.CacheTTL = time.Second * 30
+	}
+
+	return &TokenVersionVerifier{
+		Verifier: verifier,
+		db:       db,
+		cache:    newTTLCache(conf.CacheSize, conf.CacheTTL),
+	}
+}
+
+// Verify validates the token using the wrapped Verifier, returning
+// ErrTokenOutdated if the token version has since been bumped.
+func (v *TokenVersionVerifier) Verify(inputStr string) (AuthToken, error) {
+	return v.VerifyContext(context.Background(), inputStr)
+}
+
+// VerifyContext is Verify using the provided context.
+func (v *TokenVersionVerifier) VerifyContext(ctx context.Context, inputStr string) (AuthToken, error) {
+	return v.verify(ctx, inputStr, false)
+}
+
+// VerifyIgnoringExpiry validates the token (ignoring expiry) using the wrapped
+// Verifier, returning ErrTokenOutdated if the token version has been bumped.
+func (v *TokenVersionVerifier) VerifyIgnoringExpiry(inputStr string) (AuthToken, error) {
+	return v.VerifyIgnoringExpiryContext(context.Background(), inputStr)
+}
+
+// VerifyIgnoringExpiryContext is VerifyIgnoringExpiry using the provided context.
+func (v *TokenVersionVerifier) VerifyIgnoringExpiryContext(ctx context.Context, inputStr string) (AuthToken, error) {
+	return v.verify(ctx, inputStr, true)
+}
+
+// verify provides the underlying functionality for the Verify methods.
+func (v *TokenVersionVerifier) verify(ctx context.Context, inputStr string, ignoreExpiry bool) (AuthToken, error) {
+	authToken, err := verifyContext(ctx, v.Verifier, inputStr, ignoreExpiry)
+	if err != nil {
+		return AuthToken{}, err
+	}
+
+	return authToken, v.check(ctx, authToken)
+}
+
+// check returns ErrTokenOutdated if the token version is below the
+// (possibly cached) minimum version of its subject.
+func (v *TokenVersionVerifier) check(ctx context.Context, authToken AuthToken) error {
+	minVersion, ok := v.cache.get(authToken.Subject)
+	if !ok {
+		// as with RevocationVerifier, versions read while a bump
+		// notification is handled are not cached
+		generation := v.cache.generation()
+
+		var err error
+		minVersion, err = CurrentTokenVersionContext(ctx, v.db, authToken.Subject)
+		if err != nil {
+			return err
+		}
+
+		v.cache.setIfGeneration(authToken.Subject, minVersion, generation)
+	}
+
+	if authToken.TokenVersion < minVersion.(int) {
+		return ErrTokenOutdated
+	}
+
+	return nil
+}
+
+// Listen subscribes to RevocationChannel using a dedicated connection,
+// invalidating cached versions as they are bumped, so that outdated tokens
+// are rejected within moments across every process. Listen blocks until ctx
+// is cancelled.
+func (v *TokenVersionVerifier) Listen(ctx context.Context, conf database.Config) error {
+	return listenRevocations(ctx, conf, v.handleNotification, v.cache.purge)
+}
+
+// handleNotification invalidates the cache entries described by a
+// "tver:<subject>" RevocationChannel payload.
+func (v *TokenVersionVerifier) handleNotification(payload string) {
+	if !strings.HasPrefix(payload, "tver:") {
+		return
+	}
+
+	subject := strings.TrimPrefix(payload, "tver:")
+	if subject == AllSubjects {
+		v.cache.purge()
+		return
+	}
+
+	v.cache.delete(subject)
+}
+
+// CurrentTokenVersion returns the version new tokens issued to subject
+// must carry, the greater of the subject and system-wide minimum versions
+// (defaulting to 1).
+func CurrentTokenVersion(db *database.DB, subject string) (int, error) {
+	return CurrentTokenVersionContext(context.Background(), db, subject)
+}
+
+// CurrentTokenVersionContext is CurrentTokenVersion using the provided context.
+func CurrentTokenVersionContext(ctx context.Context, db *database.DB, subject string) (int, error) {
+	var version int
+	err := db.View(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		version, err = CurrentTokenVersionTx(tx, subject)
+		return err
+	})
+
+	return version, err
+}
+
+// CurrentTokenVersionTx is CurrentTokenVersion using an existing transaction.
+func CurrentTokenVersionTx(tx *sqlx.Tx, subject string) (int, error) {
+	var version int
+	err := tx.Get(&version, `
+	SELECT COALESCE(MAX(v.min_version), 1) FROM jwt_token_versions v
+	WHERE v.subject = $1 OR v.subject = $2
+	`, subject, AllSubjects)
+
+	return version, err
+}
+
+// BumpTokenVersion increments the minimum token version of subject (or of
+// every subject when AllSubjects is provided), immediately outdating every
+// token issued to it. The new version is returned.
+func BumpTokenVersion(db *database.DB, subject string) (int, error) {
+	return BumpTokenVersionContext(context.Background(), db, subject)
+}
+
+// BumpTokenVersionContext is BumpTokenVersion using the provided context.
+func BumpTokenVersionContext(ctx context.Context, db *database.DB, subject string) (int, error) {
+	var version int
+	err := db.Update(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		version, err = BumpTokenVersionTx(tx, subject)
+		return err
+	})
+
+	return version, err
+}
+
+// BumpTokenVersionTx is BumpTokenVersion using an existing transaction, the
+// notification is delivered once the transaction commits.
+func BumpTokenVersionTx(tx *sqlx.Tx, subject string) (int, error) {
+	version, err := CurrentTokenVersionTx(tx, subject)
+	if err != nil {
+		return 0, err
+	}
+
+	version++
+	err = SetMinTokenVersionTx(tx, subject, version)
+	return version, err
+}
+
+// SetMinTokenVersion sets the minimum token version of subject (or of every
+// subject when AllSubjects is provided).
+func SetMinTokenVersion(db *database.DB, subject string, version int) error {
+	return SetMinTokenVersionContext(context.Background(), db, subject, version)
+}
+
+// SetMinTokenVersionContext is SetMinTokenVersion using the provided context.
+func SetMinTokenVersionContext(ctx context.Context, db *database.DB, subject string, version int) error {
+	return db.Update(ctx, func(tx *sqlx.Tx) error {
+		return SetMinTokenVersionTx(tx, subject, version)
+	})
+}
+
+// SetMinTokenVersionTx is SetMinTokenVersion using an existing transaction, the
+// notification is delivered once the transaction commits.
+func SetMinTokenVersionTx(tx *sqlx.Tx, subject string, version int) error {
+	_, err := tx.Exec(`
+	INSERT INTO jwt_token_versions (subject, min_version, updated_at)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (subject) DO UPDATE SET
+		min_version = EXCLUDED.min_version,
+		updated_at = EXCLUDED.updated_at
+	`, subject, version, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	return notifyRevocation(tx, "tver:"+subject)
+}
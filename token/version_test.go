@@ -0,0 +1,48 @@
+package token
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTokenVersionVerifierNotifications(t *testing.T) {
+	verifier := NewTokenVersionVerifier(nil, nil, TokenVersionConfig{})
+	verifier.cache.set("alice", 2)
+	verifier.cache.set("bob", 1)
+
+	verifier.handleNotification("sub:alice")
+	if _, ok := verifier.cache.get("alice"); !ok {
+		t.Error("expected revocation payloads to be ignored")
+	}
+
+	verifier.handleNotification("tver:alice")
+	if _, ok := verifier.cache.get("alice"); ok {
+		t.Error("expected alice to be invalidated")
+	}
+
+	if _, ok := verifier.cache.get("bob"); !ok {
+		t.Error("expected bob to remain cached")
+	}
+
+	verifier.handleNotification("tver:" + AllSubjects)
+	if _, ok := verifier.cache.get("bob"); ok {
+		t.Error("expected every subject to be invalidated")
+	}
+}
+
+func TestTokenVersionVerifierCheck(t *testing.T) {
+	verifier := NewTokenVersionVerifier(nil, nil, TokenVersionConfig{})
+	verifier.cache.set("alice", 2)
+
+	authToken := newTestAuthToken()
+	authToken.Subject = "alice"
+	authToken.TokenVersion = 1
+	if err := verifier.check(context.Background(), authToken); err != ErrTokenOutdated {
+		t.Errorf("expected '%v' but got '%v'", ErrTokenOutdated, err)
+	}
+
+	authToken.TokenVersion = 2
+	if err := verifier.check(context.Background(), authToken); err != nil {
+		t.Errorf("expected token to be accepted but got '%v'", err)
+	}
+}
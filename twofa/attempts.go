@@ -0,0 +1,162 @@
+package twofa
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/cosmotek/api-commons/database"
+)
+
+// AttemptPolicy configures how many failed verification attempts are
+// tolerated before a code is invalidated, or its recipient is locked out.
+type AttemptPolicy struct {
+	// MaxRequestAttempts is the number of wrong guesses after which an
+	// outstanding code is invalidated, and a new one must be requested.
+	// Zero disables the limit.
+	MaxRequestAttempts int
+
+	// LockoutThreshold is the number of consecutive failures (across every
+	// code sent to a recipient) after which the recipient is locked out.
+	LockoutThreshold int
+
+	// BaseLockout is the duration of the first lockout, each further failure
+	// doubles the lockout up to MaxLockout. When MaxLockout is zero the
+	// lockout is not doubled, every lockout lasts BaseLockout.
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+}
+
+// DefaultAttemptPolicy is the default AttemptPolicy of DefaultPolicy.
+var DefaultAttemptPolicy = AttemptPolicy{
+	MaxRequestAttempts: 5,
+	LockoutThreshold:   10,
+	BaseLockout:        time.Minute,
+	MaxLockout:         time.Hour * 24,
+}
+
+// AttemptLimitError is returned when verification is refused because too many
+// failed attempts have been made, APIs should respond with 429 Too Many
+// Requests (and a Retry-After header when RetryAfter is set).
+type AttemptLimitError struct {
+	// RetryAfter is the remaining lockout duration, zero when the code was
+	// invalidated and a new code may be requested immediately.
+	RetryAfter time.Duration
+
+	// CodeInvalidated is set when the outstanding code was invalidated
+	// after too many wrong guesses.
+	CodeInvalidated bool
+}
+
+// Error implements the error interface.
+func (e *AttemptLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("user error: too many failed attempts, retry in %s", e.RetryAfter.Round(time.Second))
+	}
+
+	return "user error: too many failed attempts, please request a new code"
+}
+
+// lockout returns the lockout duration after the provided number of
+// consecutive failures, zero when below the threshold.
+func (p AttemptPolicy) lockout(failures int) time.Duration {
+	if p.LockoutThreshold <= 0 || failures < p.LockoutThreshold {
+		return 0
+	}
+
+	duration := p.BaseLockout
+	if p.MaxLockout <= 0 {
+		return duration
+	}
+
+	for i := p.LockoutThreshold; i < failures && duration < p.MaxLockout; i++ {
+		duration *= 2
+	}
+
+	if duration > p.MaxLockout {
+		return p.MaxLockout
+	}
+
+	return duration
+}
+
+// checkAttemptLock returns an AttemptLimitError if key is locked out.
+func checkAttemptLock(tx *sqlx.Tx, key string, now time.Time) error {
+	var lockedUntil sql.NullTime
+	err := tx.Get(&lockedUntil, `SELECT a.locked_until FROM twofa_attempts a WHERE a.key = $1 FOR UPDATE`, key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+
+		return err
+	}
+
+	if lockedUntil.Valid && lockedUntil.Time.After(now) {
+		return &AttemptLimitError{RetryAfter: lockedUntil.Time.Sub(now)}
+	}
+
+	return nil
+}
+
+// recordFailedAttempt increments the consecutive failure count of key,
+// locking it out according to policy. The lockout duration is returned.
+func recordFailedAttempt(tx *sqlx.Tx, key string, policy AttemptPolicy, now time.Time) (time.Duration, error) {
+	var failures int
+	err := tx.Get(&failures, `
+	INSERT INTO twofa_attempts (key, failures, updated_at)
+	VALUES ($1, 1, $2)
+	ON CONFLICT (key) DO UPDATE SET
+		failures = twofa_attempts.failures + 1,
+		updated_at = EXCLUDED.updated_at
+	RETURNING failures
+	`, key, now)
+	if err != nil {
+		return 0, err
+	}
+
+	lockout := policy.lockout(failures)
+	if lockout > 0 {
+		_, err = tx.Exec(`UPDATE twofa_attempts SET locked_until = $2 WHERE key = $1`, key, now.Add(lockout))
+	}
+
+	return lockout, err
+}
+
+// requestAttemptsExceeded reports whether a code with the provided number of
+// failed attempts has reached the per-request limit of the policy.
+func (p AttemptPolicy) requestAttemptsExceeded(failedAttempts int) bool {
+	return p.MaxRequestAttempts > 0 && failedAttempts >= p.MaxRequestAttempts
+}
+
+// resetAttempts clears the failure count of key after a successful attempt.
+func resetAttempts(tx *sqlx.Tx, key string) error {
+	_, err := tx.Exec(`DELETE FROM twofa_attempts WHERE key = $1`, key)
+	return err
+}
+
+// verifyWithAttempts runs verify in a read-write transaction, returning its
+// error once the transaction completes. Failed attempts must be committed to
+// be counted, so verify reports whether the transaction should be committed:
+// true along with the verification failure (if any) once the attempt has been
+// recorded, or false along with a database error, rolling it back.
+func verifyWithAttempts(ctx context.Context, db *database.DB, verify func(tx *sqlx.Tx) (bool, error)) error {
+	var verifyErr error
+	err := db.Update(ctx, func(tx *sqlx.Tx) error {
+		commit, err := verify(tx)
+		if !commit {
+			return err
+		}
+
+		verifyErr = err
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return verifyErr
+}
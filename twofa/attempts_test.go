@@ -0,0 +1,96 @@
+package twofa
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttemptPolicyLockout(t *testing.T) {
+	policy := AttemptPolicy{
+		LockoutThreshold: 3,
+		BaseLockout:      time.Minute,
+		MaxLockout:       time.Minute * 10,
+	}
+
+	scenarios := map[string]struct {
+		Failures int
+		Lockout  time.Duration
+	}{
+		"should not lock out below the threshold": {Failures: 2, Lockout: 0},
+		"should lock out at the threshold":        {Failures: 3, Lockout: time.Minute},
+		"should double the lockout":               {Failures: 5, Lockout: time.Minute * 4},
+		"should cap the lockout":                  {Failures: 50, Lockout: time.Minute * 10},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			if lockout := policy.lockout(scene.Failures); lockout != scene.Lockout {
+				t.Errorf("expected lockout of %s but got %s", scene.Lockout, lockout)
+			}
+		})
+	}
+}
+
+func TestAttemptPolicyLockoutWithoutMax(t *testing.T) {
+	policy := AttemptPolicy{
+		LockoutThreshold: 3,
+		BaseLockout:      time.Minute,
+	}
+
+	for _, failures := range []int{3, 4, 10, 100} {
+		if lockout := policy.lockout(failures); lockout != time.Minute {
+			t.Errorf("expected a fixed lockout of 1m0s after %d failures but got %s", failures, lockout)
+		}
+	}
+}
+
+func TestAttemptLimitErrorMessage(t *testing.T) {
+	var err error = &AttemptLimitError{RetryAfter: time.Minute}
+	if err.Error() != "user error: too many failed attempts, retry in 1m0s" {
+		t.Errorf("unexpected message '%s'", err.Error())
+	}
+
+	err = &AttemptLimitError{CodeInvalidated: true}
+	if err.Error() != "user error: too many failed attempts, please request a new code" {
+		t.Errorf("unexpected message '%s'", err.Error())
+	}
+}
+
+func TestVerifySMSPincodeInvalidatesAfterMaxAttempts(t *testing.T) {
+	db := testDatabase(t)
+	policy := DefaultPolicy.Attempts
+
+	phoneNumber := "+1555" + mustGenerateCode(NumericAlphabet, 7)
+	_, pincode, err := CreateSMSPincode(db, phoneNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrongPincode := "x" + pincode[1:]
+	for i := 1; i <= policy.MaxRequestAttempts; i++ {
+		_, err = VerifySMSPincode(db, phoneNumber, wrongPincode)
+		if i < policy.MaxRequestAttempts && err != ErrSMSPincodeInvalid {
+			t.Fatalf("expected ErrSMSPincodeInvalid after %d failures, got %v", i, err)
+		}
+	}
+
+	limitErr, ok := err.(*AttemptLimitError)
+	if !ok || !limitErr.CodeInvalidated {
+		t.Fatalf("expected the pincode to be invalidated, got %v", err)
+	}
+
+	var remaining int
+	err = db.DB.Get(&remaining, `SELECT COUNT(*) FROM sms_pincodes WHERE phone_number = $1`, phoneNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if remaining != 0 {
+		t.Fatalf("expected the pincode row to be deleted, %d remain", remaining)
+	}
+
+	_, err = VerifySMSPincode(db, phoneNumber, pincode)
+	if err == nil {
+		t.Fatal("expected the invalidated pincode to be rejected")
+	}
+}
@@ -0,0 +1,199 @@
+package twofa
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/cosmotek/api-commons/database"
+)
+
+const (
+	// BackupCodeCount is the number of recovery codes generated per batch.
+	BackupCodeCount = 10
+
+	// backupCodeLength is the number of characters in a recovery code,
+	// giving 50 bits of entropy using backupCodeAlphabet.
+	backupCodeLength = 10
+
+	// backupCodeAlphabet is case-insensitive and excludes ambiguous
+	// characters, as recovery codes are typically written down.
+	backupCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+	// backupCodePurpose is bound into the hashes of recovery codes.
+	backupCodePurpose = "backup_code"
+)
+
+// ErrBackupCodeInvalid is returned when a recovery code does not exist
+// or has already been used.
+var ErrBackupCodeInvalid = errors.New("user error: recovery code is invalid or has already been used")
+
+// GenerateBackupCodes generates a batch of BackupCodeCount single-use recovery
+// codes for subject, formatted as XXXXX-XXXXX, replacing (and invalidating) any
+// existing codes. Only keyed hashes (see Policy.SecretKey) are stored, so the
+// codes must be shown to the user immediately.
+func GenerateBackupCodes(db *database.DB, subject string) ([]string, error) {
+	return GenerateBackupCodesContext(context.Background(), db, subject)
+}
+
+// GenerateBackupCodesContext is GenerateBackupCodes using the provided context.
+func GenerateBackupCodesContext(ctx context.Context, db *database.DB, subject string) ([]string, error) {
+	return DefaultPolicy.GenerateBackupCodesContext(ctx, db, subject)
+}
+
+// GenerateBackupCodesTx is GenerateBackupCodes using an existing transaction.
+func GenerateBackupCodesTx(tx *sqlx.Tx, subject string) ([]string, error) {
+	return DefaultPolicy.GenerateBackupCodesTx(tx, subject)
+}
+
+// GenerateBackupCodesContext is the package level GenerateBackupCodesContext using the policy.
+func (p Policy) GenerateBackupCodesContext(ctx context.Context, db *database.DB, subject string) ([]string, error) {
+	var codes []string
+	err := db.Update(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		codes, err = p.GenerateBackupCodesTx(tx, subject)
+		return err
+	})
+
+	return codes, err
+}
+
+// GenerateBackupCodesTx is the package level GenerateBackupCodesTx using the policy.
+func (p Policy) GenerateBackupCodesTx(tx *sqlx.Tx, subject string) ([]string, error) {
+	err := p.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM twofa_backup_codes WHERE subject = $1`, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	codes := make([]string, 0, BackupCodeCount)
+	for len(codes) < BackupCodeCount {
+		code, err := GenerateCode(backupCodeAlphabet, backupCodeLength)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.Exec(`
+		INSERT INTO twofa_backup_codes (subject, code_hash, created_at)
+		VALUES ($1, $2, $3)
+		`, subject, hashSecret(p.SecretKey, backupCodePurpose, subject, code), now)
+		if err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code[:backupCodeLength/2]+"-"+code[backupCodeLength/2:])
+	}
+
+	return codes, nil
+}
+
+// ConsumeBackupCode verifies a recovery code for subject and marks it as used,
+// in a single statement so that a code cannot be used twice concurrently.
+// Codes are accepted regardless of case, spacing or dashes. Wrong guesses are
+// counted according to DefaultPolicy.Attempts, returning ErrBackupCodeInvalid
+// until subject is locked out, after which an *AttemptLimitError is returned.
+func ConsumeBackupCode(db *database.DB, subject, code string) error {
+	return ConsumeBackupCodeContext(context.Background(), db, subject, code)
+}
+
+// ConsumeBackupCodeContext is ConsumeBackupCode using the provided context.
+func ConsumeBackupCodeContext(ctx context.Context, db *database.DB, subject, code string) error {
+	return DefaultPolicy.ConsumeBackupCodeContext(ctx, db, subject, code)
+}
+
+// ConsumeBackupCodeTx is ConsumeBackupCode using an existing transaction. The
+// transaction must be committed even when verification fails, otherwise the
+// failed attempt is not counted.
+func ConsumeBackupCodeTx(tx *sqlx.Tx, subject, code string) error {
+	return DefaultPolicy.ConsumeBackupCodeTx(tx, subject, code)
+}
+
+// ConsumeBackupCodeContext is the package level ConsumeBackupCodeContext using the policy.
+func (p Policy) ConsumeBackupCodeContext(ctx context.Context, db *database.DB, subject, code string) error {
+	return verifyWithAttempts(ctx, db, func(tx *sqlx.Tx) (bool, error) {
+		return consumeBackupCode(tx, subject, code, p)
+	})
+}
+
+// ConsumeBackupCodeTx is the package level ConsumeBackupCodeTx using the policy.
+func (p Policy) ConsumeBackupCodeTx(tx *sqlx.Tx, subject, code string) error {
+	_, err := consumeBackupCode(tx, subject, code, p)
+	return err
+}
+
+// consumeBackupCode provides the underlying functionality for ConsumeBackupCode,
+// reporting whether the transaction should be committed (see
+// verifyWithAttempts).
+func consumeBackupCode(tx *sqlx.Tx, subject, code string, policy Policy) (bool, error) {
+	err := policy.Validate()
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now().UTC()
+	attemptKey := "backup:" + subject
+
+	err = checkAttemptLock(tx, attemptKey, now)
+	if err != nil {
+		_, limited := err.(*AttemptLimitError)
+		return limited, err
+	}
+
+	code = normalizeBackupCode(code)
+	res, err := tx.Exec(`
+	UPDATE twofa_backup_codes SET used_at = $3
+	WHERE subject = $1 AND code_hash = $2 AND used_at IS NULL
+	`, subject, hashSecret(policy.SecretKey, backupCodePurpose, subject, code), now)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if rows > 0 {
+		err = resetAttempts(tx, attemptKey)
+		return err == nil, err
+	}
+
+	lockout, err := recordFailedAttempt(tx, attemptKey, policy.Attempts, now)
+	if err != nil {
+		return false, err
+	}
+
+	if lockout > 0 {
+		return true, &AttemptLimitError{RetryAfter: lockout}
+	}
+
+	return true, ErrBackupCodeInvalid
+}
+
+// RemainingBackupCodes returns the number of unused recovery codes of subject.
+func RemainingBackupCodes(db *database.DB, subject string) (int, error) {
+	return RemainingBackupCodesContext(context.Background(), db, subject)
+}
+
+// RemainingBackupCodesContext is RemainingBackupCodes using the provided context.
+func RemainingBackupCodesContext(ctx context.Context, db *database.DB, subject string) (int, error) {
+	var remaining int
+	err := db.View(ctx, func(tx *sqlx.Tx) error {
+		return tx.Get(&remaining, `SELECT COUNT(*) FROM twofa_backup_codes WHERE subject = $1 AND used_at IS NULL`, subject)
+	})
+
+	return remaining, err
+}
+
+// normalizeBackupCode strips formatting from a recovery code entered by a user.
+func normalizeBackupCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -0,0 +1,67 @@
+package twofa
+
+import "testing"
+
+func TestNormalizeBackupCode(t *testing.T) {
+	scenarios := map[string]struct {
+		Input    string
+		Expected string
+	}{
+		"should strip dashes":       {Input: "ABCDE-FGHJK", Expected: "ABCDEFGHJK"},
+		"should strip spaces":       {Input: " ABCDE FGHJK ", Expected: "ABCDEFGHJK"},
+		"should ignore letter case": {Input: "abcde-fghjk", Expected: "ABCDEFGHJK"},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			if output := normalizeBackupCode(scene.Input); output != scene.Expected {
+				t.Errorf("expected '%s' but got '%s'", scene.Expected, output)
+			}
+		})
+	}
+}
+
+func TestConsumeBackupCodeAttempts(t *testing.T) {
+	db := testDatabase(t)
+	subject := "backup-" + mustGenerateCode(NumericAlphabet, 8)
+
+	codes, err := GenerateBackupCodes(db, subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stored int
+	err = db.DB.Get(&stored, `
+	SELECT COUNT(*) FROM twofa_backup_codes WHERE subject = $1 AND code_hash = $2
+	`, subject, hashSecret(DefaultPolicy.SecretKey, backupCodePurpose, subject, normalizeBackupCode(codes[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored != 1 {
+		t.Fatal("expected recovery codes to be stored as keyed hashes")
+	}
+
+	err = ConsumeBackupCode(db, subject, codes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ConsumeBackupCode(db, subject, codes[0])
+	if err != ErrBackupCodeInvalid {
+		t.Fatalf("expected used codes to be rejected, got %v", err)
+	}
+
+	for i := 0; i < DefaultPolicy.Attempts.LockoutThreshold; i++ {
+		err = ConsumeBackupCode(db, subject, "WRONG-CODES")
+	}
+
+	if _, ok := err.(*AttemptLimitError); !ok {
+		t.Fatalf("expected subject to be locked out, got %v", err)
+	}
+
+	err = ConsumeBackupCode(db, subject, codes[1])
+	if _, ok := err.(*AttemptLimitError); !ok {
+		t.Fatalf("expected valid codes to be refused during the lockout, got %v", err)
+	}
+}
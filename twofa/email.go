@@ -2,9 +2,8 @@ package twofa
 
 import (
 	"context"
-	"encoding/base64"
+	"database/sql"
 	"errors"
-	"fmt"
 	"time"
 
 	"github.com/cosmotek/mailgo"
@@ -12,10 +11,11 @@ import (
 	"github.com/jmoiron/sqlx"
 
 	"github.com/cosmotek/api-commons/database"
+	"github.com/cosmotek/api-commons/token"
 )
 
-// magicLinkURLTemplate is used for creating magic links that
-// will be emailed to users and will open the admin dashboard.
+// magicLinkURLTemplate is the default template used for creating magic
+// links that will be emailed to users and will open the admin dashboard.
 // (DO NOT EDIT WITHOUT CORRESPONDING UI CHANGES)
 const magicLinkURLTemplate = "%s/#/handoffs/magiclinks/%s/%s/avp/%s"
 
@@ -27,8 +27,36 @@ var (
 	// ErrMagicLinkConsumed is an error returned when someone attempts
 	// to login (verify) with a consumed magic link.
 	ErrMagicLinkConsumed = errors.New("magic link has been consumed")
+
+	// ErrMagicLinkInvalid is an error returned by RedeemMagicLink when
+	// no magic link matches the request id, email and verification code.
+	ErrMagicLinkInvalid = errors.New("user error: magic link is invalid")
 )
 
+// NewEmailAuthToken returns the AuthToken issued to email once it has been
+// verified (using a magic link or WebAuthn), ready for token.Sign or
+// token.Refresher.Issue. tokenVersion should be the current version of the
+// subject (see token.CurrentTokenVersion), versions below 1 are raised to 1,
+// the lowest version accepted by token validation.
+func NewEmailAuthToken(email string, tokenVersion int, role token.Role, audience string, ttl time.Duration) token.AuthToken {
+	if tokenVersion < 1 {
+		tokenVersion = 1
+	}
+
+	now := time.Now().UTC()
+	return token.AuthToken{
+		ID:           uuid.New().String(),
+		TokenVersion: tokenVersion,
+		Role:         role,
+		Audience:     audience,
+		Subject:      email,
+		SubjectType:  token.Email,
+		IssuedAt:     now,
+		NotBefore:    now,
+		ExpiresAt:    now.Add(ttl),
+	}
+}
+
 // SendHTMLEmail generates and sends an email
 // using the provided HTML string, returning the sender
 // email (with formatted name included).
@@ -47,41 +75,62 @@ func SendHTMLEmail(messenger mailgo.Messenger, emailHTML, subject, recipientEmai
 type magicLink struct {
 	RequestID        string    `json:"requestId" db:"id"`
 	Email            string    `json:"email" db:"email"`
-	VerificationCode string    `json:"verificationCode" db:"verification_code"`
+	VerificationCode string    `json:"verificationCode" db:"-"`
 	ExpiresAt        time.Time `json:"expiresAt" db:"expires_at"`
 	Consumed         bool      `json:"consumed" db:"consumed"`
+
+	// VerificationCodeHash is the keyed hash of the verification code (see
+	// hashSecret), LegacyVerificationCode is only set for rows created before
+	// verification codes were hashed.
+	VerificationCodeHash   sql.NullString `json:"-" db:"verification_code_hash"`
+	LegacyVerificationCode sql.NullString `json:"-" db:"verification_code"`
+
+	// CodeHash is the keyed hash of the optional one-time code (see
+	// CreateEmailCode), which expires at CodeExpiresAt.
+	CodeHash       sql.NullString `json:"-" db:"code_hash"`
+	CodeExpiresAt  sql.NullTime   `json:"-" db:"code_expires_at"`
+	FailedAttempts int            `json:"-" db:"failed_attempts"`
+
+	// CodeChallenge is the optional S256 code challenge binding the link to
+	// the device which requested it (see CreateMagicLinkWithChallenge).
+	CodeChallenge sql.NullString `json:"-" db:"code_challenge"`
 }
 
-// generateMagicLinkURL creates a magic link url using the template,
+// generateMagicLinkURL creates a magic link url using the policy,
 // host url, and the magic link input (which includes metadata required).
-func generateMagicLinkURL(hostURL string, input magicLink) string {
-	return fmt.Sprintf(
-		magicLinkURLTemplate,
-		hostURL,
-		base64.RawURLEncoding.EncodeToString([]byte(input.Email)),
-		input.RequestID,
-		input.VerificationCode,
-	)
+func generateMagicLinkURL(policy Policy, hostURL string, input magicLink) string {
+	return policy.magicLinkURL(hostURL, input.Email, input.RequestID, input.VerificationCode)
 }
 
 // VerifyMagicLink searches the database for a magic link with the
 // matching requestId, email and verification code. This functional
 // also checks if the link has expired and returns ErrMagicLinkExpired
-// if that is the case.
+// if that is the case. Prefer RedeemMagicLink, which verifies and
+// consumes the link atomically.
 func VerifyMagicLink(db *database.DB, requestID, email, verificationCode string) error {
-	queryStr := `
-	SELECT m.expires_at FROM email_magiclinks m 
-	WHERE
-		m.id = $1 AND
-		m.email = $2 AND
-		m.verification_code = $3
-	LIMIT 1;
-	`
+	return VerifyMagicLinkContext(context.Background(), db, requestID, email, verificationCode)
+}
 
-	mlink := magicLink{}
-	err := db.View(context.Background(), func(tx *sqlx.Tx) error {
-		return tx.Get(&mlink, queryStr, requestID, email, verificationCode)
+// VerifyMagicLinkContext is VerifyMagicLink using the provided context.
+func VerifyMagicLinkContext(ctx context.Context, db *database.DB, requestID, email, verificationCode string) error {
+	return DefaultPolicy.VerifyMagicLinkContext(ctx, db, requestID, email, verificationCode)
+}
+
+// VerifyMagicLinkTx is VerifyMagicLink using an existing transaction.
+func VerifyMagicLinkTx(tx *sqlx.Tx, requestID, email, verificationCode string) error {
+	return DefaultPolicy.VerifyMagicLinkTx(tx, requestID, email, verificationCode)
+}
+
+// VerifyMagicLinkContext is the package level VerifyMagicLinkContext using the policy.
+func (p Policy) VerifyMagicLinkContext(ctx context.Context, db *database.DB, requestID, email, verificationCode string) error {
+	return db.View(ctx, func(tx *sqlx.Tx) error {
+		return p.VerifyMagicLinkTx(tx, requestID, email, verificationCode)
 	})
+}
+
+// VerifyMagicLinkTx is the package level VerifyMagicLinkTx using the policy.
+func (p Policy) VerifyMagicLinkTx(tx *sqlx.Tx, requestID, email, verificationCode string) error {
+	mlink, err := getMagicLink(tx, p, requestID, email, verificationCode, "", false)
 	if err != nil {
 		return err
 	}
@@ -97,60 +146,232 @@ func VerifyMagicLink(db *database.DB, requestID, email, verificationCode string)
 	return nil
 }
 
-// ConsumeMagicLink marks a link as "consumed" in the database. This function should
-// be called when a magic link has been verified and a token has been issued.
-func ConsumeMagicLink(db *database.DB, requestID, email, verificationCode string) error {
+// getMagicLink retrieves the magic link with the matching requestId and email,
+// returning sql.ErrNoRows if it does not exist or the verification code does
+// not match (using the secret key of the policy), and
+// ErrMagicLinkVerifierInvalid if the link is bound to a code challenge which
+// codeVerifier does not match. The link is locked for the transaction when
+// forUpdate is set.
+func getMagicLink(tx *sqlx.Tx, policy Policy, requestID, email, verificationCode, codeVerifier string, forUpdate bool) (magicLink, error) {
+	err := policy.Validate()
+	if err != nil {
+		return magicLink{}, err
+	}
+
 	queryStr := `
-	UPDATE
-		email_magiclinks m
-	SET
-		consumed = TRUE
+	SELECT m.id, m.email, m.verification_code_hash, m.verification_code, m.code_challenge, m.expires_at, m.consumed
+	FROM email_magiclinks m
 	WHERE
 		m.id = $1 AND
-		m.email = $2 AND
-		m.verification_code = $3;
+		m.email = $2
 	`
+	if forUpdate {
+		queryStr += "FOR UPDATE"
+	}
+
+	mlink := magicLink{}
+	err = tx.Get(&mlink, queryStr, requestID, email)
+	if err != nil {
+		return magicLink{}, err
+	}
+
+	if !secretMatches(policy.SecretKey, magicLinkPurpose, email, verificationCode, mlink.VerificationCodeHash, mlink.LegacyVerificationCode) {
+		return magicLink{}, sql.ErrNoRows
+	}
+
+	if mlink.CodeChallenge.Valid && !codeVerifierMatches(codeVerifier, mlink.CodeChallenge.String) {
+		return magicLink{}, ErrMagicLinkVerifierInvalid
+	}
+
+	return mlink, nil
+}
+
+// ConsumeMagicLink marks a link as "consumed" in the database. This function should
+// be called when a magic link has been verified and a token has been issued.
+// Prefer RedeemMagicLink, as two requests may both verify a link before either
+// consumes it.
+func ConsumeMagicLink(db *database.DB, requestID, email, verificationCode string) error {
+	return ConsumeMagicLinkContext(context.Background(), db, requestID, email, verificationCode)
+}
+
+// ConsumeMagicLinkContext is ConsumeMagicLink using the provided context.
+func ConsumeMagicLinkContext(ctx context.Context, db *database.DB, requestID, email, verificationCode string) error {
+	return DefaultPolicy.ConsumeMagicLinkContext(ctx, db, requestID, email, verificationCode)
+}
+
+// ConsumeMagicLinkTx is ConsumeMagicLink using an existing transaction, allowing
+// the link to be consumed atomically with issuing a token.
+func ConsumeMagicLinkTx(tx *sqlx.Tx, requestID, email, verificationCode string) error {
+	return DefaultPolicy.ConsumeMagicLinkTx(tx, requestID, email, verificationCode)
+}
+
+// ConsumeMagicLinkContext is the package level ConsumeMagicLinkContext using the policy.
+func (p Policy) ConsumeMagicLinkContext(ctx context.Context, db *database.DB, requestID, email, verificationCode string) error {
+	return db.Update(ctx, func(tx *sqlx.Tx) error {
+		return p.ConsumeMagicLinkTx(tx, requestID, email, verificationCode)
+	})
+}
+
+// ConsumeMagicLinkTx is the package level ConsumeMagicLinkTx using the policy.
+func (p Policy) ConsumeMagicLinkTx(tx *sqlx.Tx, requestID, email, verificationCode string) error {
+	_, err := getMagicLink(tx, p, requestID, email, verificationCode, "", true)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
 
-	err := db.Update(context.Background(), func(tx *sqlx.Tx) error {
-		_, err := tx.Exec(queryStr, requestID, email, verificationCode)
 		return err
+	}
+
+	_, err = tx.Exec(`UPDATE email_magiclinks SET consumed = TRUE WHERE id = $1`, requestID)
+	return err
+}
+
+// RedeemMagicLink verifies a magic link and marks it as consumed in a single
+// transaction, locking the link so that it can only be redeemed once, even by
+// concurrent requests. ErrMagicLinkInvalid, ErrMagicLinkConsumed or
+// ErrMagicLinkExpired are returned when the link cannot be redeemed, and
+// ErrMagicLinkVerifierInvalid when the link was created with a code challenge
+// (see RedeemMagicLinkWithVerifier).
+func RedeemMagicLink(db *database.DB, requestID, email, verificationCode string) error {
+	return RedeemMagicLinkContext(context.Background(), db, requestID, email, verificationCode)
+}
+
+// RedeemMagicLinkContext is RedeemMagicLink using the provided context.
+func RedeemMagicLinkContext(ctx context.Context, db *database.DB, requestID, email, verificationCode string) error {
+	return DefaultPolicy.RedeemMagicLinkContext(ctx, db, requestID, email, verificationCode)
+}
+
+// RedeemMagicLinkTx is RedeemMagicLink using an existing transaction, allowing
+// the link to be redeemed atomically with issuing a token. The link remains
+// locked until the transaction completes.
+func RedeemMagicLinkTx(tx *sqlx.Tx, requestID, email, verificationCode string) error {
+	return DefaultPolicy.RedeemMagicLinkTx(tx, requestID, email, verificationCode)
+}
+
+// RedeemMagicLinkContext is the package level RedeemMagicLinkContext using the policy.
+func (p Policy) RedeemMagicLinkContext(ctx context.Context, db *database.DB, requestID, email, verificationCode string) error {
+	return db.Update(ctx, func(tx *sqlx.Tx) error {
+		return p.RedeemMagicLinkTx(tx, requestID, email, verificationCode)
 	})
+}
+
+// RedeemMagicLinkTx is the package level RedeemMagicLinkTx using the policy.
+func (p Policy) RedeemMagicLinkTx(tx *sqlx.Tx, requestID, email, verificationCode string) error {
+	return redeemMagicLink(tx, p, requestID, email, verificationCode, "")
+}
+
+// redeemMagicLink provides the underlying functionality for RedeemMagicLink
+// and RedeemMagicLinkWithVerifier.
+func redeemMagicLink(tx *sqlx.Tx, policy Policy, requestID, email, verificationCode, codeVerifier string) error {
+	mlink, err := getMagicLink(tx, policy, requestID, email, verificationCode, codeVerifier, true)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrMagicLinkInvalid
+		}
+
 		return err
 	}
 
-	return nil
+	if mlink.Consumed {
+		return ErrMagicLinkConsumed
+	}
+
+	if mlink.ExpiresAt.Before(time.Now().UTC()) {
+		return ErrMagicLinkExpired
+	}
+
+	_, err = tx.Exec(`UPDATE email_magiclinks SET consumed = TRUE WHERE id = $1`, requestID)
+	return err
 }
 
 // CreateMagicLink creates the database records later used for magic link verification
-// and returns a generated url which may be emailed to a user.
+// and returns a generated url which may be emailed to a user. The verification code
+// and url are generated according to DefaultPolicy, an error is returned if it
+// is invalid (see Policy.Validate).
 func CreateMagicLink(db *database.DB, frontendURL, email string) (string, string, error) {
+	return CreateMagicLinkContext(context.Background(), db, frontendURL, email)
+}
+
+// CreateMagicLinkContext is CreateMagicLink using the provided context.
+func CreateMagicLinkContext(ctx context.Context, db *database.DB, frontendURL, email string) (string, string, error) {
+	return DefaultPolicy.CreateMagicLinkContext(ctx, db, frontendURL, email)
+}
+
+// CreateMagicLinkTx is CreateMagicLink using an existing transaction.
+func CreateMagicLinkTx(tx *sqlx.Tx, frontendURL, email string) (string, string, error) {
+	return DefaultPolicy.CreateMagicLinkTx(tx, frontendURL, email)
+}
+
+// CreateMagicLinkContext is the package level CreateMagicLinkContext using the policy.
+func (p Policy) CreateMagicLinkContext(ctx context.Context, db *database.DB, frontendURL, email string) (string, string, error) {
+	var id, url string
+	err := db.Update(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		id, url, err = p.CreateMagicLinkTx(tx, frontendURL, email)
+		return err
+	})
+
+	return id, url, err
+}
+
+// CreateMagicLinkTx is the package level CreateMagicLinkTx using the policy.
+func (p Policy) CreateMagicLinkTx(tx *sqlx.Tx, frontendURL, email string) (string, string, error) {
+	mlink, err := newMagicLink(p, email)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = insertMagicLink(tx, mlink)
+	return mlink.RequestID, generateMagicLinkURL(p, frontendURL, mlink), err
+}
+
+// newMagicLink generates a magic link record for email using the policy.
+func newMagicLink(policy Policy, email string) (magicLink, error) {
+	err := policy.Validate()
+	if err != nil {
+		return magicLink{}, err
+	}
+
+	code, err := GenerateCode(policy.MagicLinkAlphabet, policy.MagicLinkCodeLength)
+	if err != nil {
+		return magicLink{}, err
+	}
+
+	return magicLink{
+		RequestID:        uuid.New().String(),
+		Email:            email,
+		VerificationCode: code,
+		ExpiresAt:        time.Now().UTC().Add(policy.MagicLinkTTL),
+		VerificationCodeHash: sql.NullString{
+			String: hashSecret(policy.SecretKey, magicLinkPurpose, email, code),
+			Valid:  true,
+		},
+	}, nil
+}
+
+// insertMagicLink writes a magic link record to the database.
+func insertMagicLink(tx *sqlx.Tx, mlink magicLink) error {
 	queryStr := `
 	INSERT INTO email_magiclinks (
 		id,
 		email,
-		verification_code,
+		verification_code_hash,
+		code_hash,
+		code_expires_at,
+		code_challenge,
 		expires_at
 	) VALUES (
 		:id,
 		:email,
-		:verification_code,
+		:verification_code_hash,
+		:code_hash,
+		:code_expires_at,
+		:code_challenge,
 		:expires_at
 	);
 	`
 
-	id := uuid.New().String()
-	mlink := magicLink{
-		RequestID:        id,
-		Email:            email,
-		VerificationCode: GenerateAlphaNumericCode(36),
-		ExpiresAt:        time.Now().UTC().Add(time.Hour * 48),
-	}
-
-	err := db.Update(context.Background(), func(tx *sqlx.Tx) error {
-		_, err := tx.NamedExec(queryStr, mlink)
-		return err
-	})
-
-	return id, generateMagicLinkURL(frontendURL, mlink), err
+	_, err := tx.NamedExec(queryStr, mlink)
+	return err
 }
@@ -0,0 +1,261 @@
+package twofa
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+
+	"github.com/cosmotek/api-commons/database"
+)
+
+// emailCodePurpose is bound into the hashes of email one-time codes.
+const emailCodePurpose = "email_code"
+
+var (
+	// ErrEmailCodeExpired is an error returned when someone attempts
+	// to login with an expired email code.
+	ErrEmailCodeExpired = errors.New("email code has expired")
+
+	// ErrEmailCodeInvalid is an error returned when an email code does not
+	// match the login request.
+	ErrEmailCodeInvalid = errors.New("user error: email code is invalid")
+)
+
+// CreateEmailCode creates the database records later used for email code
+// verification, returning the request id and a short one-time code which
+// may be emailed to a user (see MagicLinkEmailParams.Code). Unlike magic
+// links, the code is typed into the device which requested the login, so
+// the request id must be kept by that device. The code is generated
+// according to DefaultPolicy.
+func CreateEmailCode(db *database.DB, email string) (string, string, error) {
+	return CreateEmailCodeContext(context.Background(), db, email)
+}
+
+// CreateEmailCodeContext is CreateEmailCode using the provided context.
+func CreateEmailCodeContext(ctx context.Context, db *database.DB, email string) (string, string, error) {
+	return DefaultPolicy.CreateEmailCodeContext(ctx, db, email)
+}
+
+// CreateEmailCodeTx is CreateEmailCode using an existing transaction.
+func CreateEmailCodeTx(tx *sqlx.Tx, email string) (string, string, error) {
+	return DefaultPolicy.CreateEmailCodeTx(tx, email)
+}
+
+// CreateEmailCodeContext is the package level CreateEmailCodeContext using the policy.
+func (p Policy) CreateEmailCodeContext(ctx context.Context, db *database.DB, email string) (string, string, error) {
+	var id, code string
+	err := db.Update(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		id, code, err = p.CreateEmailCodeTx(tx, email)
+		return err
+	})
+
+	return id, code, err
+}
+
+// CreateEmailCodeTx is the package level CreateEmailCodeTx using the policy.
+func (p Policy) CreateEmailCodeTx(tx *sqlx.Tx, email string) (string, string, error) {
+	mlink := magicLink{
+		RequestID: uuid.New().String(),
+		Email:     email,
+		ExpiresAt: time.Now().UTC().Add(p.EmailCodeTTL),
+	}
+
+	code, err := addEmailCode(p, &mlink)
+	if err != nil {
+		return "", "", err
+	}
+
+	return mlink.RequestID, code, insertMagicLink(tx, mlink)
+}
+
+// CreateMagicLinkWithCode creates a magic link as CreateMagicLink does, along
+// with a one-time code for the same login request, so that an email may
+// contain both and the user can choose. Redeeming either consumes both.
+// The request id, url and code are returned.
+func CreateMagicLinkWithCode(db *database.DB, frontendURL, email string) (string, string, string, error) {
+	return CreateMagicLinkWithCodeContext(context.Background(), db, frontendURL, email)
+}
+
+// CreateMagicLinkWithCodeContext is CreateMagicLinkWithCode using the provided context.
+func CreateMagicLinkWithCodeContext(ctx context.Context, db *database.DB, frontendURL, email string) (string, string, string, error) {
+	return DefaultPolicy.CreateMagicLinkWithCodeContext(ctx, db, frontendURL, email)
+}
+
+// CreateMagicLinkWithCodeTx is CreateMagicLinkWithCode using an existing transaction.
+func CreateMagicLinkWithCodeTx(tx *sqlx.Tx, frontendURL, email string) (string, string, string, error) {
+	return DefaultPolicy.CreateMagicLinkWithCodeTx(tx, frontendURL, email)
+}
+
+// CreateMagicLinkWithCodeContext is the package level CreateMagicLinkWithCodeContext using the policy.
+func (p Policy) CreateMagicLinkWithCodeContext(ctx context.Context, db *database.DB, frontendURL, email string) (string, string, string, error) {
+	var id, url, code string
+	err := db.Update(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		id, url, code, err = p.CreateMagicLinkWithCodeTx(tx, frontendURL, email)
+		return err
+	})
+
+	return id, url, code, err
+}
+
+// CreateMagicLinkWithCodeTx is the package level CreateMagicLinkWithCodeTx using the policy.
+func (p Policy) CreateMagicLinkWithCodeTx(tx *sqlx.Tx, frontendURL, email string) (string, string, string, error) {
+	mlink, err := newMagicLink(p, email)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	code, err := addEmailCode(p, &mlink)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	err = insertMagicLink(tx, mlink)
+	return mlink.RequestID, generateMagicLinkURL(p, frontendURL, mlink), code, err
+}
+
+// addEmailCode generates a one-time code using the policy, storing its hash
+// and expiry in the magic link record. The code is returned.
+func addEmailCode(policy Policy, mlink *magicLink) (string, error) {
+	err := policy.Validate()
+	if err != nil {
+		return "", err
+	}
+
+	code, err := GenerateCode(policy.EmailCodeAlphabet, policy.EmailCodeLength)
+	if err != nil {
+		return "", err
+	}
+
+	mlink.CodeHash = sql.NullString{
+		String: hashSecret(policy.SecretKey, emailCodePurpose, mlink.Email, code),
+		Valid:  true,
+	}
+	mlink.CodeExpiresAt = sql.NullTime{
+		Time:  time.Now().UTC().Add(policy.EmailCodeTTL),
+		Valid: true,
+	}
+
+	return code, nil
+}
+
+// RedeemEmailCode verifies an email code and consumes its login request in a
+// single transaction, so that it can only be redeemed once. Wrong guesses are
+// counted according to DefaultPolicy.Attempts, returning ErrEmailCodeInvalid
+// until the code is invalidated or the email is locked out, after which an
+// *AttemptLimitError is returned. ErrEmailCodeExpired or ErrMagicLinkConsumed
+// are returned when a matching code can no longer be used.
+func RedeemEmailCode(db *database.DB, requestID, email, code string) error {
+	return RedeemEmailCodeContext(context.Background(), db, requestID, email, code)
+}
+
+// RedeemEmailCodeContext is RedeemEmailCode using the provided context.
+func RedeemEmailCodeContext(ctx context.Context, db *database.DB, requestID, email, code string) error {
+	return DefaultPolicy.RedeemEmailCodeContext(ctx, db, requestID, email, code)
+}
+
+// RedeemEmailCodeTx is RedeemEmailCode using an existing transaction. The
+// transaction must be committed even when verification fails, otherwise the
+// failed attempt is not counted.
+func RedeemEmailCodeTx(tx *sqlx.Tx, requestID, email, code string) error {
+	return DefaultPolicy.RedeemEmailCodeTx(tx, requestID, email, code)
+}
+
+// RedeemEmailCodeContext is the package level RedeemEmailCodeContext using the policy.
+func (p Policy) RedeemEmailCodeContext(ctx context.Context, db *database.DB, requestID, email, code string) error {
+	return verifyWithAttempts(ctx, db, func(tx *sqlx.Tx) (bool, error) {
+		return redeemEmailCode(tx, requestID, email, code, p)
+	})
+}
+
+// RedeemEmailCodeTx is the package level RedeemEmailCodeTx using the policy.
+func (p Policy) RedeemEmailCodeTx(tx *sqlx.Tx, requestID, email, code string) error {
+	_, err := redeemEmailCode(tx, requestID, email, code, p)
+	return err
+}
+
+// redeemEmailCode provides the underlying functionality for RedeemEmailCode,
+// reporting whether the transaction should be committed (see
+// verifyWithAttempts).
+func redeemEmailCode(tx *sqlx.Tx, requestID, email, code string, policy Policy) (bool, error) {
+	err := policy.Validate()
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now().UTC()
+	attemptKey := "email:" + email
+
+	err = checkAttemptLock(tx, attemptKey, now)
+	if err != nil {
+		_, limited := err.(*AttemptLimitError)
+		return limited, err
+	}
+
+	mlink := magicLink{}
+	err = tx.Get(&mlink, `
+	SELECT m.id, m.email, m.code_hash, m.code_expires_at, m.consumed, m.failed_attempts
+	FROM email_magiclinks m
+	WHERE
+		m.id = $1 AND
+		m.email = $2
+	FOR UPDATE;
+	`, requestID, email)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+
+	if err == nil && secretMatches(policy.SecretKey, emailCodePurpose, email, code, mlink.CodeHash, sql.NullString{}) {
+		if mlink.Consumed {
+			return true, ErrMagicLinkConsumed
+		}
+
+		if mlink.CodeExpiresAt.Time.Before(now) {
+			return true, ErrEmailCodeExpired
+		}
+
+		_, err = tx.Exec(`UPDATE email_magiclinks SET consumed = TRUE WHERE id = $1`, requestID)
+		if err != nil {
+			return false, err
+		}
+
+		err = resetAttempts(tx, attemptKey)
+		return err == nil, err
+	}
+
+	// count the wrong guess against the code, invalidating it (but not the
+	// magic link sent alongside it) once it reaches the attempt limit
+	invalidated := false
+	if err == nil && mlink.CodeHash.Valid {
+		err = tx.Get(&invalidated, `
+		UPDATE email_magiclinks SET
+			failed_attempts = failed_attempts + 1,
+			code_hash = CASE WHEN $2 > 0 AND failed_attempts + 1 >= $2 THEN NULL ELSE code_hash END
+		WHERE id = $1
+		RETURNING code_hash IS NULL
+		`, requestID, policy.Attempts.MaxRequestAttempts)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	lockout, err := recordFailedAttempt(tx, attemptKey, policy.Attempts, now)
+	if err != nil {
+		return false, err
+	}
+
+	if lockout > 0 {
+		return true, &AttemptLimitError{RetryAfter: lockout, CodeInvalidated: invalidated}
+	}
+
+	if invalidated {
+		return true, &AttemptLimitError{CodeInvalidated: true}
+	}
+
+	return true, ErrEmailCodeInvalid
+}
@@ -0,0 +1,74 @@
+package twofa
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateMagicLinkEmailHTMLCode(t *testing.T) {
+	scenarios := map[string]struct {
+		Params    MagicLinkEmailParams
+		HasButton bool
+		HasCode   bool
+	}{
+		"should render the magic link only": {
+			Params:    MagicLinkEmailParams{ButtonURL: "https://example.com/link", ButtonLabel: "Log In"},
+			HasButton: true,
+		},
+		"should render the code only": {
+			Params:  MagicLinkEmailParams{Code: "482913"},
+			HasCode: true,
+		},
+		"should render both the magic link and code": {
+			Params:    MagicLinkEmailParams{ButtonURL: "https://example.com/link", ButtonLabel: "Log In", Code: "482913"},
+			HasButton: true,
+			HasCode:   true,
+		},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			html, err := GenerateMagicLinkEmailHTML(scene.Params)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Contains(html, `href="https://example.com/link"`) != scene.HasButton {
+				t.Fatalf("expected button %v", scene.HasButton)
+			}
+
+			if strings.Contains(html, "482913") != scene.HasCode {
+				t.Fatalf("expected code %v", scene.HasCode)
+			}
+		})
+	}
+}
+
+func TestRedeemEmailCode(t *testing.T) {
+	db := testDatabase(t)
+
+	email := "code-" + mustGenerateCode(NumericAlphabet, 8) + "@example.com"
+	id, url, code, err := CreateMagicLinkWithCode(db, "https://example.com", email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RedeemEmailCode(db, id, email, "not the code")
+	if err != ErrEmailCodeInvalid {
+		t.Fatalf("expected ErrEmailCodeInvalid, got %v", err)
+	}
+
+	succeeded := redeemConcurrently(t, func() error {
+		return RedeemEmailCode(db, id, email, code)
+	})
+
+	if succeeded != 1 {
+		t.Fatalf("expected exactly one redemption to succeed, got %d", succeeded)
+	}
+
+	// the magic link sent alongside the code is consumed with it
+	err = RedeemMagicLink(db, id, email, url[strings.LastIndex(url, "/")+1:])
+	if err != ErrMagicLinkConsumed {
+		t.Fatalf("expected ErrMagicLinkConsumed, got %v", err)
+	}
+}
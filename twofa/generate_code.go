@@ -1,36 +1,82 @@
 package twofa
 
 import (
-	"math/rand"
-	"strconv"
-	"time"
+	"crypto/rand"
+	"errors"
+	"fmt"
 )
 
-const alphanumericKeyBank = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz1234567890"
+const (
+	// NumericAlphabet is the alphabet used for SMS pincodes.
+	NumericAlphabet = "0123456789"
 
-// init is run when the package is imported (prior to app's main function)
-func init() {
-	rand.Seed(time.Now().UnixNano())
+	// AlphaNumericAlphabet is the alphabet used for email verification codes.
+	AlphaNumericAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz1234567890"
+
+	// UnambiguousAlphabet is an alpha-numeric alphabet excluding characters
+	// which are easily confused when read or typed by a person (0/O/o, 1/I/l).
+	UnambiguousAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnpqrstuvwxyz23456789"
+)
+
+// GenerateCode generates a random code of the provided length (at least 1)
+// using characters from alphabet (of between 2 and 256 single-byte characters).
+// Characters are sampled from crypto/rand without modulo bias.
+func GenerateCode(alphabet string, length int) (string, error) {
+	if len(alphabet) < 2 || len(alphabet) > 256 {
+		return "", errors.New("failed to generate code, alphabet must contain between 2 and 256 characters")
+	}
+
+	if length < 1 {
+		return "", errors.New("failed to generate code, length must be at least 1")
+	}
+
+	// bytes at or above limit are rejected, so that every character
+	// of the alphabet is equally likely
+	limit := 256 - (256 % len(alphabet))
+
+	output := make([]byte, 0, length)
+	buff := make([]byte, length+length/2+1)
+	for len(output) < length {
+		_, err := rand.Read(buff)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate code: %v", err)
+		}
+
+		for _, b := range buff {
+			if int(b) >= limit {
+				continue
+			}
+
+			output = append(output, alphabet[int(b)%len(alphabet)])
+			if len(output) == length {
+				break
+			}
+		}
+	}
+
+	return string(output), nil
 }
 
-// GenerateNumericPincode generates a numeric pincode of
-// the provided length for use in SMS verification.
-func GenerateNumericPincode(length int) string {
-	output := ""
-	for i := 0; i < length; i++ {
-		char := strconv.Itoa(rand.Intn(10))
-		output += char
+// mustGenerateCode wraps GenerateCode for the fixed package alphabets, which
+// only fails for lengths below 1 or if the system's secure random number
+// generator fails.
+func mustGenerateCode(alphabet string, length int) string {
+	code, err := GenerateCode(alphabet, length)
+	if err != nil {
+		panic(err)
 	}
-	return output
+
+	return code
 }
 
-// GenerateAlphaNumericCode generates a alpha-numeric pincode of
-// the provided length for use in Email verification.
+// GenerateNumericPincode generates a numeric pincode of the provided
+// length for use in SMS verification, panicking if length is below 1.
+func GenerateNumericPincode(length int) string {
+	return mustGenerateCode(NumericAlphabet, length)
+}
+
+// GenerateAlphaNumericCode generates a alpha-numeric pincode of the provided
+// length for use in Email verification, panicking if length is below 1.
 func GenerateAlphaNumericCode(length int) string {
-	output := ""
-	for i := 0; i < length; i++ {
-		keyindex := rand.Intn(len(alphanumericKeyBank))
-		output += string(alphanumericKeyBank[keyindex])
-	}
-	return output
+	return mustGenerateCode(AlphaNumericAlphabet, length)
 }
@@ -0,0 +1,110 @@
+package twofa
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestGenerateCodeLength(t *testing.T) {
+	scenarios := map[string]struct {
+		Generate func(length int) string
+		Alphabet string
+	}{
+		"numeric pincodes": {
+			Generate: GenerateNumericPincode,
+			Alphabet: NumericAlphabet,
+		},
+		"alpha-numeric codes": {
+			Generate: GenerateAlphaNumericCode,
+			Alphabet: AlphaNumericAlphabet,
+		},
+		"unambiguous codes": {
+			Generate: func(length int) string {
+				code, err := GenerateCode(UnambiguousAlphabet, length)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return code
+			},
+			Alphabet: UnambiguousAlphabet,
+		},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			for _, length := range []int{1, 4, 6, 36, 257} {
+				code := scene.Generate(length)
+				if len(code) != length {
+					t.Errorf("expected code of length %d but got %d", length, len(code))
+				}
+
+				for _, char := range code {
+					if !strings.ContainsRune(scene.Alphabet, char) {
+						t.Errorf("unexpected character '%c' in code '%s'", char, code)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateCodeDistribution(t *testing.T) {
+	// 62 characters do not divide 256 evenly, so modulo bias
+	// would favour the first 8 characters of the alphabet
+	alphabet := AlphaNumericAlphabet
+	samples := 620000
+
+	code, err := GenerateCode(alphabet, samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[rune]int{}
+	for _, char := range code {
+		counts[char]++
+	}
+
+	if len(counts) != len(alphabet) {
+		t.Fatalf("expected every character to be generated but got %d of %d", len(counts), len(alphabet))
+	}
+
+	// chi-squared goodness of fit against a uniform distribution, 61 degrees of
+	// freedom has a critical value of ~128.9 at p = 0.000001
+	expected := float64(samples) / float64(len(alphabet))
+	chiSquared := 0.0
+	for _, count := range counts {
+		chiSquared += math.Pow(float64(count)-expected, 2) / expected
+	}
+
+	if chiSquared > 128.9 {
+		t.Errorf("expected uniform distribution but got chi-squared of %.2f", chiSquared)
+	}
+}
+
+func TestGenerateCodeRejectsInvalidAlphabets(t *testing.T) {
+	for _, alphabet := range []string{"", "a", strings.Repeat("a", 257)} {
+		if _, err := GenerateCode(alphabet, 6); err == nil {
+			t.Errorf("expected alphabet of length %d to be rejected", len(alphabet))
+		}
+	}
+}
+
+func TestGenerateCodeRejectsInvalidLengths(t *testing.T) {
+	scenarios := map[string]struct {
+		Length int
+	}{
+		"should reject an empty code":     {Length: 0},
+		"should reject a negative length": {Length: -1},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			code, err := GenerateCode(NumericAlphabet, scene.Length)
+			if err == nil {
+				t.Fatalf("expected length %d to be rejected, got code '%s'", scene.Length, code)
+			}
+		})
+	}
+}
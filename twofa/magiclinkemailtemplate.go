@@ -119,9 +119,13 @@ const magicLinkEmailTemplate = `
     <p>{{.}}</p>
   {{end}}
 
-          </div></td></tr><tr><td style="word-break:break-word;font-size:0px;padding:10px 25px;" align="center"><table role="presentation" cellpadding="0" cellspacing="0" style="border-collapse:separate;" align="center" border="0"><tbody><tr><td style="border:none;border-radius:3px;color:white;cursor:auto;padding:15px 19px;" align="center" valign="middle" bgcolor="#6bc064"><a href="{{.ButtonURL}}" style="text-decoration:none;line-height:100%;background:#6bc064;color:white;font-family:Ubuntu, Helvetica, Arial, sans-serif;font-size:15px;font-weight:normal;text-transform:none;margin:0px;" target="_blank">
+  {{if .Code}}
+    <p style="font-family: Ubuntu, Helvetica, Arial, sans-serif;font-size: 32px;font-weight: 600;letter-spacing: 6px;color: #4F545C;text-align: center;">{{.Code}}</p>
+  {{end}}
+
+          </div></td></tr>{{if .ButtonURL}}<tr><td style="word-break:break-word;font-size:0px;padding:10px 25px;" align="center"><table role="presentation" cellpadding="0" cellspacing="0" style="border-collapse:separate;" align="center" border="0"><tbody><tr><td style="border:none;border-radius:3px;color:white;cursor:auto;padding:15px 19px;" align="center" valign="middle" bgcolor="#6bc064"><a href="{{.ButtonURL}}" style="text-decoration:none;line-height:100%;background:#6bc064;color:white;font-family:Ubuntu, Helvetica, Arial, sans-serif;font-size:15px;font-weight:normal;text-transform:none;margin:0px;" target="_blank">
             {{.ButtonLabel}}
-          </a></td></tr></tbody></table></td></tr></tbody></table></div><!--[if mso | IE]>
+          </a></td></tr></tbody></table></td></tr>{{end}}</tbody></table></div><!--[if mso | IE]>
       </td></tr></table>
       <![endif]--></td></tr></tbody></table></div><!--[if mso | IE]>
       </td></tr></table>
@@ -185,10 +189,15 @@ type MagicLinkEmailParams struct {
 	Messages    []string
 	ButtonURL   string
 	ButtonLabel string
+
+	// Code is an optional one-time code (see CreateEmailCode) displayed
+	// below the messages, the button is omitted when ButtonURL is empty.
+	Code string
 }
 
 // GenerateMagicLinkEmailHTML generates an HTML email from template using
-// provided recipient/sender information returning the HTML string.
+// provided recipient/sender information returning the HTML string. The
+// email may contain a magic link, a one-time code or both.
 func GenerateMagicLinkEmailHTML(templateData MagicLinkEmailParams) (string, error) {
 	buff := bytes.NewBuffer([]byte{})
 	err := tmpl.Execute(buff, templateData)
@@ -0,0 +1,16 @@
+package twofa
+
+import (
+	"embed"
+
+	"github.com/cosmotek/api-commons/database"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migrations is the schema of the tables used by this package (sms_pincodes,
+// email_magiclinks, totp_secrets, twofa_backup_codes, twofa_attempts,
+// webauthn_credentials and webauthn_challenges), applied by
+// database.Database.SyncMigrations when included in database.Config.Migrations.
+var Migrations = database.NewEmbeddedMigrationSource("api-commons/twofa", migrationFiles, "migrations")
@@ -0,0 +1,18 @@
+-- sms_pincodes stores pincodes sent by text, see CreateSMSPincode.
+CREATE TABLE IF NOT EXISTS sms_pincodes (
+	id TEXT PRIMARY KEY,
+	phone_number TEXT NOT NULL,
+	pincode TEXT NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS sms_pincodes_phone_number_idx ON sms_pincodes (phone_number);
+
+-- email_magiclinks stores magic link verification codes, see CreateMagicLink.
+CREATE TABLE IF NOT EXISTS email_magiclinks (
+	id TEXT PRIMARY KEY,
+	email TEXT NOT NULL,
+	verification_code TEXT NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL,
+	consumed BOOLEAN NOT NULL DEFAULT FALSE
+);
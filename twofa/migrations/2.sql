@@ -0,0 +1,9 @@
+-- totp_secrets stores AES-GCM encrypted authenticator app secrets, see TOTP.
+CREATE TABLE IF NOT EXISTS totp_secrets (
+	subject TEXT PRIMARY KEY,
+	secret BYTEA NOT NULL,
+	confirmed BOOLEAN NOT NULL DEFAULT FALSE,
+	last_used_step BIGINT NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ NOT NULL,
+	confirmed_at TIMESTAMPTZ
+);
@@ -0,0 +1,8 @@
+-- twofa_backup_codes stores hashed single-use recovery codes, see GenerateBackupCodes.
+CREATE TABLE IF NOT EXISTS twofa_backup_codes (
+	subject TEXT NOT NULL,
+	code_hash TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	used_at TIMESTAMPTZ,
+	PRIMARY KEY (subject, code_hash)
+);
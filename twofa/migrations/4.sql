@@ -0,0 +1,11 @@
+-- failed_attempts counts wrong guesses against an outstanding pincode.
+ALTER TABLE sms_pincodes ADD COLUMN IF NOT EXISTS failed_attempts INTEGER NOT NULL DEFAULT 0;
+
+-- twofa_attempts counts consecutive failed verification attempts per
+-- recipient (e.g. "sms:<phone number>"), see AttemptPolicy.
+CREATE TABLE IF NOT EXISTS twofa_attempts (
+	key TEXT PRIMARY KEY,
+	failures INTEGER NOT NULL DEFAULT 0,
+	locked_until TIMESTAMPTZ,
+	updated_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,26 @@
+-- webauthn_credentials stores WebAuthn credentials (passkeys), the id is the
+-- base64url encoded credential id and public_key the COSE encoded key.
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+	id TEXT PRIMARY KEY,
+	subject TEXT NOT NULL,
+	user_handle BYTEA NOT NULL,
+	public_key BYTEA NOT NULL,
+	sign_count BIGINT NOT NULL DEFAULT 0,
+	aaguid BYTEA,
+	disabled BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TIMESTAMPTZ NOT NULL,
+	last_used_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS webauthn_credentials_subject_idx ON webauthn_credentials (subject);
+
+-- webauthn_challenges stores outstanding ceremony challenges, each is
+-- deleted once used.
+CREATE TABLE IF NOT EXISTS webauthn_challenges (
+	id UUID PRIMARY KEY,
+	subject TEXT NOT NULL,
+	challenge BYTEA NOT NULL,
+	ceremony TEXT NOT NULL,
+	user_handle BYTEA,
+	expires_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,8 @@
+-- pincodes and verification codes are stored as keyed hashes (see
+-- Policy.SecretKey), the plaintext columns are only kept for rows created
+-- before hashing, which remain verifiable until they expire.
+ALTER TABLE sms_pincodes ADD COLUMN IF NOT EXISTS pincode_hash TEXT;
+ALTER TABLE sms_pincodes ALTER COLUMN pincode DROP NOT NULL;
+
+ALTER TABLE email_magiclinks ADD COLUMN IF NOT EXISTS verification_code_hash TEXT;
+ALTER TABLE email_magiclinks ALTER COLUMN verification_code DROP NOT NULL;
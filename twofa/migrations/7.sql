@@ -0,0 +1,6 @@
+-- code_hash stores the keyed hash of the optional one-time code sent with
+-- (or instead of) a magic link, see CreateEmailCode. failed_attempts counts
+-- wrong guesses against the code.
+ALTER TABLE email_magiclinks ADD COLUMN IF NOT EXISTS code_hash TEXT;
+ALTER TABLE email_magiclinks ADD COLUMN IF NOT EXISTS code_expires_at TIMESTAMPTZ;
+ALTER TABLE email_magiclinks ADD COLUMN IF NOT EXISTS failed_attempts INTEGER NOT NULL DEFAULT 0;
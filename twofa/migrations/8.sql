@@ -0,0 +1,3 @@
+-- code_challenge stores the optional S256 code challenge binding a magic
+-- link to the device which requested it, see CreateMagicLinkWithChallenge.
+ALTER TABLE email_magiclinks ADD COLUMN IF NOT EXISTS code_challenge TEXT;
@@ -0,0 +1,143 @@
+package twofa
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"regexp"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/cosmotek/api-commons/database"
+)
+
+var (
+	// ErrCodeChallengeInvalid is returned when a code challenge is not an
+	// S256 challenge (the unpadded base64url encoded sha256 of a verifier).
+	ErrCodeChallengeInvalid = errors.New("user error: code challenge is invalid")
+
+	// ErrMagicLinkVerifierInvalid is an error returned when a magic link
+	// bound to a code challenge is redeemed without the matching verifier,
+	// such as when the link is opened on another device.
+	ErrMagicLinkVerifierInvalid = errors.New("user error: magic link must be opened on the device which requested it")
+)
+
+var (
+	// codeChallengePattern matches S256 code challenges (RFC 7636).
+	codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+	// codeVerifierPattern matches code verifiers (RFC 7636).
+	codeVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+)
+
+// codeVerifierAlphabet is the unreserved alphabet of code verifiers.
+const codeVerifierAlphabet = AlphaNumericAlphabet + "-._~"
+
+// GenerateCodeVerifier generates a random code verifier along with its S256
+// code challenge, for clients written in Go. The verifier is kept by the
+// requesting device, while the challenge is sent with the login request.
+func GenerateCodeVerifier() (string, string, error) {
+	verifier, err := GenerateCode(codeVerifierAlphabet, 64)
+	if err != nil {
+		return "", "", err
+	}
+
+	return verifier, CodeChallengeS256(verifier), nil
+}
+
+// CodeChallengeS256 returns the S256 code challenge of a verifier, the
+// unpadded base64url encoded sha256 hash of the verifier.
+func CodeChallengeS256(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return encodeBase64URL(sum[:])
+}
+
+// codeVerifierMatches compares the S256 challenge of a verifier to the
+// stored challenge in constant time.
+func codeVerifierMatches(codeVerifier, codeChallenge string) bool {
+	if !codeVerifierPattern.MatchString(codeVerifier) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(CodeChallengeS256(codeVerifier)), []byte(codeChallenge)) == 1
+}
+
+// CreateMagicLinkWithChallenge creates a magic link as CreateMagicLink does,
+// bound to the S256 code challenge of the device requesting the login, so that
+// the link can only be redeemed (see RedeemMagicLinkWithVerifier) using the
+// matching verifier kept by that device. The url format is unchanged, the
+// frontend opening the link supplies the verifier from its own storage.
+func CreateMagicLinkWithChallenge(db *database.DB, frontendURL, email, codeChallenge string) (string, string, error) {
+	return CreateMagicLinkWithChallengeContext(context.Background(), db, frontendURL, email, codeChallenge)
+}
+
+// CreateMagicLinkWithChallengeContext is CreateMagicLinkWithChallenge using the provided context.
+func CreateMagicLinkWithChallengeContext(ctx context.Context, db *database.DB, frontendURL, email, codeChallenge string) (string, string, error) {
+	return DefaultPolicy.CreateMagicLinkWithChallengeContext(ctx, db, frontendURL, email, codeChallenge)
+}
+
+// CreateMagicLinkWithChallengeTx is CreateMagicLinkWithChallenge using an existing transaction.
+func CreateMagicLinkWithChallengeTx(tx *sqlx.Tx, frontendURL, email, codeChallenge string) (string, string, error) {
+	return DefaultPolicy.CreateMagicLinkWithChallengeTx(tx, frontendURL, email, codeChallenge)
+}
+
+// CreateMagicLinkWithChallengeContext is the package level CreateMagicLinkWithChallengeContext using the policy.
+func (p Policy) CreateMagicLinkWithChallengeContext(ctx context.Context, db *database.DB, frontendURL, email, codeChallenge string) (string, string, error) {
+	var id, url string
+	err := db.Update(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		id, url, err = p.CreateMagicLinkWithChallengeTx(tx, frontendURL, email, codeChallenge)
+		return err
+	})
+
+	return id, url, err
+}
+
+// CreateMagicLinkWithChallengeTx is the package level CreateMagicLinkWithChallengeTx using the policy.
+func (p Policy) CreateMagicLinkWithChallengeTx(tx *sqlx.Tx, frontendURL, email, codeChallenge string) (string, string, error) {
+	if !codeChallengePattern.MatchString(codeChallenge) {
+		return "", "", ErrCodeChallengeInvalid
+	}
+
+	mlink, err := newMagicLink(p, email)
+	if err != nil {
+		return "", "", err
+	}
+
+	mlink.CodeChallenge = sql.NullString{String: codeChallenge, Valid: true}
+	err = insertMagicLink(tx, mlink)
+	return mlink.RequestID, generateMagicLinkURL(p, frontendURL, mlink), err
+}
+
+// RedeemMagicLinkWithVerifier redeems a magic link as RedeemMagicLink does,
+// additionally requiring codeVerifier to match the code challenge of links
+// created by CreateMagicLinkWithChallenge. ErrMagicLinkVerifierInvalid is
+// returned when it does not. Links created without a challenge are redeemed
+// regardless of the verifier.
+func RedeemMagicLinkWithVerifier(db *database.DB, requestID, email, verificationCode, codeVerifier string) error {
+	return RedeemMagicLinkWithVerifierContext(context.Background(), db, requestID, email, verificationCode, codeVerifier)
+}
+
+// RedeemMagicLinkWithVerifierContext is RedeemMagicLinkWithVerifier using the provided context.
+func RedeemMagicLinkWithVerifierContext(ctx context.Context, db *database.DB, requestID, email, verificationCode, codeVerifier string) error {
+	return DefaultPolicy.RedeemMagicLinkWithVerifierContext(ctx, db, requestID, email, verificationCode, codeVerifier)
+}
+
+// RedeemMagicLinkWithVerifierTx is RedeemMagicLinkWithVerifier using an existing transaction.
+func RedeemMagicLinkWithVerifierTx(tx *sqlx.Tx, requestID, email, verificationCode, codeVerifier string) error {
+	return DefaultPolicy.RedeemMagicLinkWithVerifierTx(tx, requestID, email, verificationCode, codeVerifier)
+}
+
+// RedeemMagicLinkWithVerifierContext is the package level RedeemMagicLinkWithVerifierContext using the policy.
+func (p Policy) RedeemMagicLinkWithVerifierContext(ctx context.Context, db *database.DB, requestID, email, verificationCode, codeVerifier string) error {
+	return db.Update(ctx, func(tx *sqlx.Tx) error {
+		return p.RedeemMagicLinkWithVerifierTx(tx, requestID, email, verificationCode, codeVerifier)
+	})
+}
+
+// RedeemMagicLinkWithVerifierTx is the package level RedeemMagicLinkWithVerifierTx using the policy.
+func (p Policy) RedeemMagicLinkWithVerifierTx(tx *sqlx.Tx, requestID, email, verificationCode, codeVerifier string) error {
+	return redeemMagicLink(tx, p, requestID, email, verificationCode, codeVerifier)
+}
@@ -0,0 +1,72 @@
+package twofa
+
+import "testing"
+
+func TestCodeChallengeS256(t *testing.T) {
+	// RFC 7636 appendix B
+	challenge := CodeChallengeS256("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if challenge != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Fatalf("unexpected code challenge %s", challenge)
+	}
+}
+
+func TestCodeVerifierMatches(t *testing.T) {
+	verifier, challenge, err := GenerateCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !codeChallengePattern.MatchString(challenge) {
+		t.Fatalf("generated challenge %s is not a valid S256 challenge", challenge)
+	}
+
+	otherVerifier, _, err := GenerateCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := map[string]struct {
+		Verifier string
+		Matches  bool
+	}{
+		"should match the verifier":             {Verifier: verifier, Matches: true},
+		"should not match another verifier":     {Verifier: otherVerifier},
+		"should not match a missing verifier":   {Verifier: ""},
+		"should not match the challenge":        {Verifier: challenge},
+		"should not match a truncated verifier": {Verifier: verifier[:42]},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			if codeVerifierMatches(scene.Verifier, challenge) != scene.Matches {
+				t.Fatalf("expected matches %v", scene.Matches)
+			}
+		})
+	}
+}
+
+func TestRedeemMagicLinkWithVerifier(t *testing.T) {
+	db := testDatabase(t)
+
+	verifier, challenge, err := GenerateCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	email := "pkce-" + mustGenerateCode(NumericAlphabet, 8) + "@example.com"
+	id, url, err := CreateMagicLinkWithChallenge(db, "https://example.com", email, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := url[len(url)-DefaultPolicy.MagicLinkCodeLength:]
+	err = RedeemMagicLink(db, id, email, code)
+	if err != ErrMagicLinkVerifierInvalid {
+		t.Fatalf("expected ErrMagicLinkVerifierInvalid without a verifier, got %v", err)
+	}
+
+	err = RedeemMagicLinkWithVerifier(db, id, email, code, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
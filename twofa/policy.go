@@ -0,0 +1,142 @@
+package twofa
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MagicLinkURLFunc builds the url of a magic link from the frontend host url
+// and the magic link details.
+type MagicLinkURLFunc func(hostURL, email, requestID, verificationCode string) string
+
+// Policy configures the codes and messages generated by this package, so
+// that products may tune them without forking. The package level functions
+// use DefaultPolicy, the methods of a Policy (such as
+// Policy.CreateSMSPincodeContext) use that policy instead, so that a process
+// may use several. Policies are checked using Validate before use.
+type Policy struct {
+	// SMSPincodeLength, SMSPincodeAlphabet and SMSPincodeTTL configure the
+	// pincodes generated by CreateSMSPincode.
+	SMSPincodeLength   int
+	SMSPincodeAlphabet string
+	SMSPincodeTTL      time.Duration
+
+	// SMSMessageTemplate is the fmt template of the text sent by
+	// SendSMSPincode, containing a single %s verb for the pincode.
+	SMSMessageTemplate string
+
+	// MagicLinkCodeLength, MagicLinkAlphabet and MagicLinkTTL configure the
+	// verification codes generated by CreateMagicLink.
+	MagicLinkCodeLength int
+	MagicLinkAlphabet   string
+	MagicLinkTTL        time.Duration
+
+	// EmailCodeLength, EmailCodeAlphabet and EmailCodeTTL configure the
+	// one-time codes generated by CreateEmailCode and CreateMagicLinkWithCode.
+	EmailCodeLength   int
+	EmailCodeAlphabet string
+	EmailCodeTTL      time.Duration
+
+	// MagicLinkURLTemplate is the fmt template of magic link urls, containing
+	// %s verbs for the host url, base64 (url) encoded email, request id and
+	// verification code, in that order. It is ignored when MagicLinkURL is set.
+	MagicLinkURLTemplate string
+
+	// MagicLinkURL optionally builds magic link urls, for urls which
+	// cannot be described by MagicLinkURLTemplate.
+	MagicLinkURL MagicLinkURLFunc
+
+	// Attempts limits failed verification attempts, its LockoutThreshold and
+	// BaseLockout are required.
+	Attempts AttemptPolicy
+
+	// SecretKey is the server secret used to HMAC pincodes, magic link
+	// verification codes and email codes before they are stored, so that only
+	// hashes are readable from the database. It is required, codes cannot be
+	// created (ErrSecretKeyMissing) until it is set during program
+	// initialization. Changing it invalidates outstanding codes.
+	SecretKey []byte
+}
+
+// DefaultPolicy is the Policy used by this package, it may be replaced
+// (or modified) during program initialization.
+var DefaultPolicy = Policy{
+	SMSPincodeLength:     4,
+	SMSPincodeAlphabet:   NumericAlphabet,
+	SMSPincodeTTL:        time.Minute * 30,
+	SMSMessageTemplate:   smsPincodeMessageTemplate,
+	MagicLinkCodeLength:  36,
+	MagicLinkAlphabet:    AlphaNumericAlphabet,
+	MagicLinkTTL:         time.Hour * 48,
+	EmailCodeLength:      6,
+	EmailCodeAlphabet:    NumericAlphabet,
+	EmailCodeTTL:         time.Minute * 15,
+	MagicLinkURLTemplate: magicLinkURLTemplate,
+	Attempts:             DefaultAttemptPolicy,
+}
+
+// magicLinkURL builds the url of a magic link using the policy.
+func (p Policy) magicLinkURL(hostURL, email, requestID, verificationCode string) string {
+	if p.MagicLinkURL != nil {
+		return p.MagicLinkURL(hostURL, email, requestID, verificationCode)
+	}
+
+	return fmt.Sprintf(
+		p.MagicLinkURLTemplate,
+		hostURL,
+		base64.RawURLEncoding.EncodeToString([]byte(email)),
+		requestID,
+		verificationCode,
+	)
+}
+
+// Validate returns an error if the policy cannot be used to create or verify
+// codes, ErrSecretKeyMissing when SecretKey is not set.
+func (p Policy) Validate() error {
+	err := p.checkSecretKey()
+	if err != nil {
+		return err
+	}
+
+	codes := []struct {
+		name     string
+		length   int
+		alphabet string
+		ttl      time.Duration
+	}{
+		{name: "SMSPincode", length: p.SMSPincodeLength, alphabet: p.SMSPincodeAlphabet, ttl: p.SMSPincodeTTL},
+		{name: "MagicLink", length: p.MagicLinkCodeLength, alphabet: p.MagicLinkAlphabet, ttl: p.MagicLinkTTL},
+		{name: "EmailCode", length: p.EmailCodeLength, alphabet: p.EmailCodeAlphabet, ttl: p.EmailCodeTTL},
+	}
+
+	for _, code := range codes {
+		if code.length < 1 {
+			return fmt.Errorf("twofa: invalid policy, %s length must be at least 1", code.name)
+		}
+
+		if len(code.alphabet) < 2 || len(code.alphabet) > 256 {
+			return fmt.Errorf("twofa: invalid policy, %s alphabet must contain between 2 and 256 characters", code.name)
+		}
+
+		if code.ttl <= 0 {
+			return fmt.Errorf("twofa: invalid policy, %s TTL must be positive", code.name)
+		}
+	}
+
+	if !strings.Contains(p.SMSMessageTemplate, "%s") {
+		return errors.New("twofa: invalid policy, SMSMessageTemplate must contain a %s verb for the pincode")
+	}
+
+	if p.MagicLinkURL == nil && p.MagicLinkURLTemplate == "" {
+		return errors.New("twofa: invalid policy, MagicLinkURLTemplate or MagicLinkURL must be set")
+	}
+
+	if p.Attempts.LockoutThreshold < 1 || p.Attempts.BaseLockout <= 0 {
+		return errors.New("twofa: invalid policy, Attempts must set LockoutThreshold and BaseLockout")
+	}
+
+	return nil
+}
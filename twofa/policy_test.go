@@ -0,0 +1,105 @@
+package twofa
+
+import (
+	"testing"
+
+	"github.com/cosmotek/nexgo"
+)
+
+func TestPolicyMagicLinkURL(t *testing.T) {
+	scenarios := map[string]struct {
+		Policy   Policy
+		Expected string
+	}{
+		"should use the default template": {
+			Policy:   DefaultPolicy,
+			Expected: "https://app.example.com/#/handoffs/magiclinks/YUBleGFtcGxlLmNvbQ/req/avp/code",
+		},
+		"should use a custom template": {
+			Policy:   Policy{MagicLinkURLTemplate: "%s/login?e=%s&id=%s&c=%s"},
+			Expected: "https://app.example.com/login?e=YUBleGFtcGxlLmNvbQ&id=req&c=code",
+		},
+		"should prefer the url builder": {
+			Policy: Policy{
+				MagicLinkURLTemplate: "%s/ignored/%s/%s/%s",
+				MagicLinkURL: func(hostURL, email, requestID, verificationCode string) string {
+					return hostURL + "/verify/" + requestID + "/" + verificationCode
+				},
+			},
+			Expected: "https://app.example.com/verify/req/code",
+		},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			url := scene.Policy.magicLinkURL("https://app.example.com", "a@example.com", "req", "code")
+			if url != scene.Expected {
+				t.Errorf("expected '%s' but got '%s'", scene.Expected, url)
+			}
+		})
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	valid := DefaultPolicy
+	valid.SecretKey = []byte("server secret")
+
+	scenarios := map[string]struct {
+		Modify func(p *Policy)
+		Valid  bool
+	}{
+		"should accept the default policy": {Modify: func(p *Policy) {}, Valid: true},
+		"should require a secret key":      {Modify: func(p *Policy) { p.SecretKey = nil }},
+		"should reject empty pincodes":     {Modify: func(p *Policy) { p.SMSPincodeLength = 0 }},
+		"should reject negative lengths":   {Modify: func(p *Policy) { p.EmailCodeLength = -1 }},
+		"should require an alphabet":       {Modify: func(p *Policy) { p.MagicLinkAlphabet = "" }},
+		"should require a ttl":             {Modify: func(p *Policy) { p.EmailCodeTTL = 0 }},
+		"should require an sms template":   {Modify: func(p *Policy) { p.SMSMessageTemplate = "" }},
+		"should require a pincode verb":    {Modify: func(p *Policy) { p.SMSMessageTemplate = "Your code" }},
+		"should require a magic link url":  {Modify: func(p *Policy) { p.MagicLinkURLTemplate = "" }},
+		"should require attempt limits":    {Modify: func(p *Policy) { p.Attempts = AttemptPolicy{} }},
+		"should accept a magic link builder": {
+			Modify: func(p *Policy) {
+				p.MagicLinkURLTemplate = ""
+				p.MagicLinkURL = func(hostURL, email, requestID, verificationCode string) string { return hostURL }
+			},
+			Valid: true,
+		},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			policy := valid
+			scene.Modify(&policy)
+
+			err := policy.Validate()
+			if scene.Valid && err != nil {
+				t.Fatalf("expected policy to be valid, got %v", err)
+			}
+
+			if !scene.Valid && err == nil {
+				t.Fatal("expected policy to be rejected")
+			}
+		})
+	}
+}
+
+func TestPolicyValidatedBeforeCreatingCodes(t *testing.T) {
+	policy := DefaultPolicy
+	policy.SecretKey = []byte("server secret")
+	policy.SMSPincodeLength = 0
+	policy.EmailCodeLength = 0
+
+	// the policy is validated before the transaction is used
+	if _, _, err := policy.CreateSMSPincodeTx(nil, "+15555550100"); err == nil {
+		t.Error("expected sms pincodes to require a valid policy")
+	}
+
+	if _, _, err := policy.CreateEmailCodeTx(nil, "user@example.com"); err == nil {
+		t.Error("expected email codes to require a valid policy")
+	}
+
+	if err := policy.SendSMSPincode(nexgo.Messenger{}, "+15555550100", "1234"); err == nil {
+		t.Error("expected sms messages to require a valid policy")
+	}
+}
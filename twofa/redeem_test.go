@@ -0,0 +1,133 @@
+package twofa
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cosmotek/api-commons/database"
+)
+
+// testDatabase connects to the postgres database described by the
+// POSTGRES_* environment variables, skipping the test when POSTGRES_HOST
+// is not set.
+func testDatabase(t *testing.T) *database.DB {
+	host := os.Getenv("POSTGRES_HOST")
+	if host == "" {
+		t.Skip("POSTGRES_HOST not set, skipping database test")
+	}
+
+	port := os.Getenv("POSTGRES_PORT")
+	if port == "" {
+		port = "5432"
+	}
+
+	db, err := database.Dial(database.Config{
+		User:         os.Getenv("POSTGRES_USER"),
+		Password:     os.Getenv("POSTGRES_PASSWORD"),
+		Host:         host,
+		Port:         port,
+		DatabaseName: os.Getenv("POSTGRES_DB"),
+		SSLDisabled:  os.Getenv("POSTGRES_SSL") != "true",
+		Migrations:   []database.MigrationSource{Migrations},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	_, err = db.SyncMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(DefaultPolicy.SecretKey) == 0 {
+		DefaultPolicy.SecretKey = []byte("test secret key")
+	}
+
+	return db
+}
+
+// redeemConcurrently calls redeem from several goroutines at once,
+// returning the number of calls which succeeded.
+func redeemConcurrently(t *testing.T, redeem func() error) int {
+	const concurrency = 8
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	start := make(chan struct{})
+	succeeded := 0
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			err := redeem()
+			if err != nil {
+				return
+			}
+
+			mutex.Lock()
+			succeeded++
+			mutex.Unlock()
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+	return succeeded
+}
+
+func TestRedeemMagicLinkConcurrently(t *testing.T) {
+	db := testDatabase(t)
+
+	email := "redeem-" + mustGenerateCode(NumericAlphabet, 8) + "@example.com"
+	id, url, err := CreateMagicLink(db, "https://example.com", email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := url[strings.LastIndex(url, "/")+1:]
+	succeeded := redeemConcurrently(t, func() error {
+		return RedeemMagicLink(db, id, email, code)
+	})
+
+	if succeeded != 1 {
+		t.Fatalf("expected exactly one redemption to succeed, got %d", succeeded)
+	}
+
+	err = RedeemMagicLink(db, id, email, code)
+	if err != ErrMagicLinkConsumed {
+		t.Fatalf("expected ErrMagicLinkConsumed, got %v", err)
+	}
+}
+
+func TestRedeemSMSPincodeConcurrently(t *testing.T) {
+	db := testDatabase(t)
+
+	phoneNumber := "+1555" + mustGenerateCode(NumericAlphabet, 7)
+	_, pincode, err := CreateSMSPincode(db, phoneNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	succeeded := redeemConcurrently(t, func() error {
+		_, err := RedeemSMSPincode(db, phoneNumber, pincode)
+		return err
+	})
+
+	if succeeded != 1 {
+		t.Fatalf("expected exactly one redemption to succeed, got %d", succeeded)
+	}
+
+	_, err = RedeemSMSPincode(db, phoneNumber, pincode)
+	if err == nil {
+		t.Fatal("expected the redeemed pincode to be rejected")
+	}
+}
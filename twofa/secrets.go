@@ -0,0 +1,139 @@
+package twofa
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/cosmotek/api-commons/database"
+)
+
+// purposes bound into the hashes of verification secrets, so that a hash
+// cannot be used in place of another kind of secret
+const (
+	smsPincodePurpose = "sms_pincode"
+	magicLinkPurpose  = "magic_link"
+)
+
+// ErrSecretKeyMissing is returned when creating (or hashing) verification
+// secrets while Policy.SecretKey is not set.
+var ErrSecretKeyMissing = errors.New("twofa: Policy.SecretKey must be set to store verification secrets")
+
+// checkSecretKey returns ErrSecretKeyMissing if the policy has no SecretKey,
+// as secrets hashed without a key can be brute forced from the database.
+func (p Policy) checkSecretKey() error {
+	if len(p.SecretKey) == 0 {
+		return ErrSecretKeyMissing
+	}
+
+	return nil
+}
+
+// hashSecret returns the hex encoded HMAC-SHA256 of a verification secret
+// using key, bound to its purpose and recipient (phone number or email).
+func hashSecret(key []byte, purpose, recipient, secret string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose + ":" + recipient + ":" + secret))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// secretMatches compares a verification secret to the stored hash in
+// constant time. Rows created before secrets were hashed have no hash, in
+// which case the plaintext secret is compared instead.
+func secretMatches(key []byte, purpose, recipient, secret string, hash, plaintext sql.NullString) bool {
+	if hash.Valid {
+		return subtle.ConstantTimeCompare([]byte(hashSecret(key, purpose, recipient, secret)), []byte(hash.String)) == 1
+	}
+
+	return plaintext.Valid && subtle.ConstantTimeCompare([]byte(plaintext.String), []byte(secret)) == 1
+}
+
+// HashLegacySecrets replaces the plaintext pincodes and magic link verification
+// codes of rows created before secrets were hashed with their hash (using
+// DefaultPolicy.SecretKey), returning the number of rows updated. Legacy rows
+// remain verifiable until they expire, so calling this is only required to
+// remove plaintext secrets from the database sooner.
+func HashLegacySecrets(db *database.DB) (int64, error) {
+	return HashLegacySecretsContext(context.Background(), db)
+}
+
+// HashLegacySecretsContext is HashLegacySecrets using the provided context.
+func HashLegacySecretsContext(ctx context.Context, db *database.DB) (int64, error) {
+	return DefaultPolicy.HashLegacySecretsContext(ctx, db)
+}
+
+// HashLegacySecretsTx is HashLegacySecrets using an existing transaction.
+func HashLegacySecretsTx(tx *sqlx.Tx) (int64, error) {
+	return DefaultPolicy.HashLegacySecretsTx(tx)
+}
+
+// HashLegacySecretsContext is the package level HashLegacySecretsContext using the policy.
+func (p Policy) HashLegacySecretsContext(ctx context.Context, db *database.DB) (int64, error) {
+	var updated int64
+	err := db.Update(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		updated, err = p.HashLegacySecretsTx(tx)
+		return err
+	})
+
+	return updated, err
+}
+
+// HashLegacySecretsTx is the package level HashLegacySecretsTx using the policy.
+func (p Policy) HashLegacySecretsTx(tx *sqlx.Tx) (int64, error) {
+	err := p.checkSecretKey()
+	if err != nil {
+		return 0, err
+	}
+
+	key := p.SecretKey
+	pins := []smsPincode{}
+	err = tx.Select(&pins, `
+	SELECT p.id, p.phone_number, p.pincode FROM sms_pincodes p
+	WHERE p.pincode_hash IS NULL AND p.pincode IS NOT NULL
+	FOR UPDATE;
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, pin := range pins {
+		_, err = tx.Exec(
+			`UPDATE sms_pincodes SET pincode_hash = $2, pincode = NULL WHERE id = $1`,
+			pin.RequestID,
+			hashSecret(key, smsPincodePurpose, pin.PhoneNumber, pin.LegacyPincode.String),
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	mlinks := []magicLink{}
+	err = tx.Select(&mlinks, `
+	SELECT m.id, m.email, m.verification_code FROM email_magiclinks m
+	WHERE m.verification_code_hash IS NULL AND m.verification_code IS NOT NULL
+	FOR UPDATE;
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, mlink := range mlinks {
+		_, err = tx.Exec(
+			`UPDATE email_magiclinks SET verification_code_hash = $2, verification_code = NULL WHERE id = $1`,
+			mlink.RequestID,
+			hashSecret(key, magicLinkPurpose, mlink.Email, mlink.LegacyVerificationCode.String),
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(pins) + len(mlinks)), nil
+}
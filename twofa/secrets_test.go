@@ -0,0 +1,100 @@
+package twofa
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestSecretMatches(t *testing.T) {
+	key := []byte("server secret")
+	hash := sql.NullString{String: hashSecret(key, smsPincodePurpose, "+15555550100", "1234"), Valid: true}
+
+	scenarios := map[string]struct {
+		Key       []byte
+		Purpose   string
+		Recipient string
+		Secret    string
+		Hash      sql.NullString
+		Plaintext sql.NullString
+		Matches   bool
+	}{
+		"should match the hashed secret": {
+			Key: key, Purpose: smsPincodePurpose, Recipient: "+15555550100", Secret: "1234", Hash: hash, Matches: true,
+		},
+		"should not match a wrong secret": {
+			Key: key, Purpose: smsPincodePurpose, Recipient: "+15555550100", Secret: "4321", Hash: hash,
+		},
+		"should not match another recipient": {
+			Key: key, Purpose: smsPincodePurpose, Recipient: "+15555550101", Secret: "1234", Hash: hash,
+		},
+		"should not match another purpose": {
+			Key: key, Purpose: magicLinkPurpose, Recipient: "+15555550100", Secret: "1234", Hash: hash,
+		},
+		"should not match using another key": {
+			Key: []byte("rotated secret"), Purpose: smsPincodePurpose, Recipient: "+15555550100", Secret: "1234", Hash: hash,
+		},
+		"should ignore the plaintext of hashed rows": {
+			Key: key, Purpose: smsPincodePurpose, Recipient: "+15555550100", Secret: "9999", Hash: hash,
+			Plaintext: sql.NullString{String: "9999", Valid: true},
+		},
+		"should match the plaintext of legacy rows": {
+			Key: key, Purpose: smsPincodePurpose, Recipient: "+15555550100", Secret: "1234",
+			Plaintext: sql.NullString{String: "1234", Valid: true}, Matches: true,
+		},
+		"should not match a wrong secret of legacy rows": {
+			Key: key, Purpose: smsPincodePurpose, Recipient: "+15555550100", Secret: "4321",
+			Plaintext: sql.NullString{String: "1234", Valid: true},
+		},
+		"should not match rows without a secret": {
+			Key: key, Purpose: smsPincodePurpose, Recipient: "+15555550100", Secret: "",
+		},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			matches := secretMatches(scene.Key, scene.Purpose, scene.Recipient, scene.Secret, scene.Hash, scene.Plaintext)
+			if matches != scene.Matches {
+				t.Fatalf("expected matches %v, got %v", scene.Matches, matches)
+			}
+		})
+	}
+}
+
+func TestSecretKeyRequired(t *testing.T) {
+	policy := DefaultPolicy
+	policy.SecretKey = nil
+
+	_, err := newMagicLink(policy, "user@example.com")
+	if err != ErrSecretKeyMissing {
+		t.Errorf("expected magic links to require a secret key, got %v", err)
+	}
+
+	mlink := magicLink{Email: "user@example.com"}
+	_, err = addEmailCode(policy, &mlink)
+	if err != ErrSecretKeyMissing {
+		t.Errorf("expected email codes to require a secret key, got %v", err)
+	}
+
+	defaultKey := DefaultPolicy.SecretKey
+	DefaultPolicy.SecretKey = nil
+	defer func() {
+		DefaultPolicy.SecretKey = defaultKey
+	}()
+
+	// the key is checked before the transaction is used
+	_, _, err = CreateSMSPincodeTx(nil, "+15555550100")
+	if err != ErrSecretKeyMissing {
+		t.Errorf("expected sms pincodes to require a secret key, got %v", err)
+	}
+
+	_, err = HashLegacySecretsTx(nil)
+	if err != ErrSecretKeyMissing {
+		t.Errorf("expected legacy hashing to require a secret key, got %v", err)
+	}
+
+	policy.SecretKey = []byte("server secret")
+	_, err = newMagicLink(policy, "user@example.com")
+	if err != nil {
+		t.Errorf("expected magic links to be created with a secret key, got %v", err)
+	}
+}
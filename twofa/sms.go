@@ -2,6 +2,7 @@ package twofa
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"time"
@@ -17,94 +18,334 @@ var (
 	// ErrSMSPincodeExpires is an error returned by the verify function
 	// if a pincode has expired.
 	ErrSMSPincodeExpired = errors.New("sms pincode has expired")
+
+	// ErrSMSPincodeInvalid is an error returned by the verify function
+	// if no outstanding pincode matches.
+	ErrSMSPincodeInvalid = errors.New("user error: sms pincode is invalid")
 )
 
 // smsPincode is used internally to retreive pincode data from the database.
 type smsPincode struct {
 	RequestID   string    `json:"requestId" db:"id"`
 	PhoneNumber string    `json:"phoneNumber" db:"phone_number"`
-	Pincode     string    `json:"pincode" db:"pincode"`
+	Pincode     string    `json:"pincode" db:"-"`
 	ExpiresAt   time.Time `json:"expiresAt" db:"expires_at"`
+
+	// PincodeHash is the keyed hash of the pincode (see hashSecret),
+	// LegacyPincode is only set for rows created before pincodes were hashed.
+	PincodeHash   sql.NullString `json:"-" db:"pincode_hash"`
+	LegacyPincode sql.NullString `json:"-" db:"pincode"`
+
+	FailedAttempts int `json:"-" db:"failed_attempts"`
 }
 
+// smsPincodeMessageTemplate is the default template of pincode texts.
 const smsPincodeMessageTemplate = `Your verification code is %s`
 
 // SendSMSPincode sends a pincode verification text using the template string
-// included internally in this package and the provided pincode string.
+// of DefaultPolicy and the provided pincode string.
 func SendSMSPincode(messenger nexgo.Messenger, phoneNumber, pincode string) error {
-	return messenger.Send("Verification Code", phoneNumber, fmt.Sprintf(smsPincodeMessageTemplate, pincode))
+	return DefaultPolicy.SendSMSPincode(messenger, phoneNumber, pincode)
+}
+
+// SendSMSPincode is the package level SendSMSPincode using the policy.
+func (p Policy) SendSMSPincode(messenger nexgo.Messenger, phoneNumber, pincode string) error {
+	err := p.Validate()
+	if err != nil {
+		return err
+	}
+
+	return messenger.Send("Verification Code", phoneNumber, fmt.Sprintf(p.SMSMessageTemplate, pincode))
 }
 
 // CreateSMSPincode creates a pincode and pincode record, writing the record
 // to the database, and returning the pincode, as well as recordId to the
-// caller (ordered id, pincode, error).
+// caller (ordered id, pincode, error). The pincode is generated according
+// to DefaultPolicy, an error is returned if it is invalid (see
+// Policy.Validate).
 func CreateSMSPincode(db *database.DB, phoneNumber string) (string, string, error) {
+	return CreateSMSPincodeContext(context.Background(), db, phoneNumber)
+}
+
+// CreateSMSPincodeContext is CreateSMSPincode using the provided context.
+func CreateSMSPincodeContext(ctx context.Context, db *database.DB, phoneNumber string) (string, string, error) {
+	return DefaultPolicy.CreateSMSPincodeContext(ctx, db, phoneNumber)
+}
+
+// CreateSMSPincodeTx is CreateSMSPincode using an existing transaction.
+func CreateSMSPincodeTx(tx *sqlx.Tx, phoneNumber string) (string, string, error) {
+	return DefaultPolicy.CreateSMSPincodeTx(tx, phoneNumber)
+}
+
+// CreateSMSPincodeContext is the package level CreateSMSPincodeContext using the policy.
+func (p Policy) CreateSMSPincodeContext(ctx context.Context, db *database.DB, phoneNumber string) (string, string, error) {
+	var id, code string
+	err := db.Update(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		id, code, err = p.CreateSMSPincodeTx(tx, phoneNumber)
+		return err
+	})
+
+	return id, code, err
+}
+
+// CreateSMSPincodeTx is the package level CreateSMSPincodeTx using the policy.
+func (p Policy) CreateSMSPincodeTx(tx *sqlx.Tx, phoneNumber string) (string, string, error) {
 	queryStr := `
 	INSERT INTO sms_pincodes (
 		id,
 		phone_number,
-		pincode,
+		pincode_hash,
 		expires_at
 	) VALUES (
 		:id,
 		:phone_number,
-		:pincode,
+		:pincode_hash,
 		:expires_at
 	);
 	`
 
-	id := uuid.New().String()
-	code := GenerateNumericPincode(4)
+	err := p.Validate()
+	if err != nil {
+		return "", "", err
+	}
+
+	code, err := GenerateCode(p.SMSPincodeAlphabet, p.SMSPincodeLength)
+	if err != nil {
+		return "", "", err
+	}
 
+	id := uuid.New().String()
 	pin := smsPincode{
 		RequestID:   id,
 		PhoneNumber: phoneNumber,
-		Pincode:     code,
-		ExpiresAt:   time.Now().UTC().Add(time.Minute * 30),
+		PincodeHash: sql.NullString{
+			String: hashSecret(p.SecretKey, smsPincodePurpose, phoneNumber, code),
+			Valid:  true,
+		},
+		ExpiresAt: time.Now().UTC().Add(p.SMSPincodeTTL),
 	}
 
-	err := db.Update(context.Background(), func(tx *sqlx.Tx) error {
-		_, err := tx.NamedExec(queryStr, pin)
-		return err
-	})
-
+	_, err = tx.NamedExec(queryStr, pin)
 	return id, code, err
 }
 
 // VerifySMSPincode searches for records in the database with the matching
 // pincode and phoneNumber, checks if the record has expired and returns the
-// requestId or ErrSMSPincodeExpired.
+// requestId or ErrSMSPincodeExpired. Wrong guesses are counted according to
+// DefaultPolicy.Attempts, returning ErrSMSPincodeInvalid until the pincode is
+// invalidated or the phone number is locked out, after which an
+// *AttemptLimitError is returned.
 func VerifySMSPincode(db *database.DB, phoneNumber, pincode string) (string, error) {
-	queryStr := `
-	SELECT p.expires_at, p.id FROM sms_pincodes p 
-	WHERE
-		p.phone_number = $1 AND
-		p.pincode = $2
-	LIMIT 1;
-	`
+	return VerifySMSPincodeContext(context.Background(), db, phoneNumber, pincode)
+}
+
+// VerifySMSPincodeContext is VerifySMSPincode using the provided context.
+func VerifySMSPincodeContext(ctx context.Context, db *database.DB, phoneNumber, pincode string) (string, error) {
+	return DefaultPolicy.VerifySMSPincodeContext(ctx, db, phoneNumber, pincode)
+}
+
+// VerifySMSPincodeTx is VerifySMSPincode using an existing transaction. The
+// transaction must be committed even when verification fails, otherwise the
+// failed attempt is not counted.
+func VerifySMSPincodeTx(tx *sqlx.Tx, phoneNumber, pincode string) (string, error) {
+	return DefaultPolicy.VerifySMSPincodeTx(tx, phoneNumber, pincode)
+}
 
-	pin := smsPincode{}
-	err := db.View(context.Background(), func(tx *sqlx.Tx) error {
-		return tx.Get(&pin, queryStr, phoneNumber, pincode)
+// VerifySMSPincodeContext is the package level VerifySMSPincodeContext using the policy.
+func (p Policy) VerifySMSPincodeContext(ctx context.Context, db *database.DB, phoneNumber, pincode string) (string, error) {
+	var requestID string
+	err := verifyWithAttempts(ctx, db, func(tx *sqlx.Tx) (bool, error) {
+		var commit bool
+		var err error
+		requestID, commit, err = verifySMSPincode(tx, phoneNumber, pincode, p)
+		return commit, err
 	})
 	if err != nil {
 		return "", err
 	}
 
-	if pin.ExpiresAt.Before(time.Now().UTC()) {
-		return "", ErrSMSPincodeExpired
+	return requestID, nil
+}
+
+// VerifySMSPincodeTx is the package level VerifySMSPincodeTx using the policy.
+func (p Policy) VerifySMSPincodeTx(tx *sqlx.Tx, phoneNumber, pincode string) (string, error) {
+	requestID, _, err := verifySMSPincode(tx, phoneNumber, pincode, p)
+	return requestID, err
+}
+
+// verifySMSPincode provides the underlying functionality for VerifySMSPincode,
+// returning the request id and whether the transaction should be committed
+// (see verifyWithAttempts).
+func verifySMSPincode(tx *sqlx.Tx, phoneNumber, pincode string, policy Policy) (string, bool, error) {
+	err := policy.Validate()
+	if err != nil {
+		return "", false, err
+	}
+
+	now := time.Now().UTC()
+	attemptKey := "sms:" + phoneNumber
+
+	err = checkAttemptLock(tx, attemptKey, now)
+	if err != nil {
+		_, limited := err.(*AttemptLimitError)
+		return "", limited, err
+	}
+
+	pins := []smsPincode{}
+	err = tx.Select(&pins, `
+	SELECT p.id, p.pincode_hash, p.pincode, p.expires_at, p.failed_attempts FROM sms_pincodes p
+	WHERE p.phone_number = $1
+	FOR UPDATE;
+	`, phoneNumber)
+	if err != nil {
+		return "", false, err
 	}
 
-	return pin.RequestID, nil
+	for _, pin := range pins {
+		if !secretMatches(policy.SecretKey, smsPincodePurpose, phoneNumber, pincode, pin.PincodeHash, pin.LegacyPincode) {
+			continue
+		}
+
+		if pin.ExpiresAt.Before(now) {
+			return "", true, ErrSMSPincodeExpired
+		}
+
+		// pincodes are deleted once they reach the limit, this guards against
+		// rows updated by an older version (or a concurrent transaction)
+		if policy.Attempts.requestAttemptsExceeded(pin.FailedAttempts) {
+			_, err = tx.Exec(`DELETE FROM sms_pincodes WHERE id = $1`, pin.RequestID)
+			if err != nil {
+				return "", false, err
+			}
+
+			return "", true, &AttemptLimitError{CodeInvalidated: true}
+		}
+
+		err = resetAttempts(tx, attemptKey)
+		return pin.RequestID, err == nil, err
+	}
+
+	// count the wrong guess against every outstanding pincode, invalidating
+	// those which have reached the attempt limit. Postgres cannot update and
+	// delete the same row in one statement, so this takes two.
+	_, err = tx.Exec(`
+	UPDATE sms_pincodes SET failed_attempts = failed_attempts + 1
+	WHERE phone_number = $1 AND expires_at > $2
+	`, phoneNumber, now)
+	if err != nil {
+		return "", false, err
+	}
+
+	var invalidated int64
+	if policy.Attempts.MaxRequestAttempts > 0 {
+		res, err := tx.Exec(`
+		DELETE FROM sms_pincodes
+		WHERE phone_number = $1 AND failed_attempts >= $2
+		`, phoneNumber, policy.Attempts.MaxRequestAttempts)
+		if err != nil {
+			return "", false, err
+		}
+
+		invalidated, err = res.RowsAffected()
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	lockout, err := recordFailedAttempt(tx, attemptKey, policy.Attempts, now)
+	if err != nil {
+		return "", false, err
+	}
+
+	if lockout > 0 {
+		return "", true, &AttemptLimitError{RetryAfter: lockout, CodeInvalidated: invalidated > 0}
+	}
+
+	if invalidated > 0 {
+		return "", true, &AttemptLimitError{CodeInvalidated: true}
+	}
+
+	return "", true, ErrSMSPincodeInvalid
+}
+
+// RedeemSMSPincode verifies a pincode as VerifySMSPincode does and deletes it
+// in the same transaction, locking the pincode so that it can only be
+// redeemed once, even by concurrent requests. The requestId is returned.
+func RedeemSMSPincode(db *database.DB, phoneNumber, pincode string) (string, error) {
+	return RedeemSMSPincodeContext(context.Background(), db, phoneNumber, pincode)
+}
+
+// RedeemSMSPincodeContext is RedeemSMSPincode using the provided context.
+func RedeemSMSPincodeContext(ctx context.Context, db *database.DB, phoneNumber, pincode string) (string, error) {
+	return DefaultPolicy.RedeemSMSPincodeContext(ctx, db, phoneNumber, pincode)
+}
+
+// RedeemSMSPincodeTx is RedeemSMSPincode using an existing transaction. As with
+// VerifySMSPincodeTx, the transaction must be committed even when verification
+// fails, otherwise the failed attempt is not counted.
+func RedeemSMSPincodeTx(tx *sqlx.Tx, phoneNumber, pincode string) (string, error) {
+	return DefaultPolicy.RedeemSMSPincodeTx(tx, phoneNumber, pincode)
+}
+
+// RedeemSMSPincodeContext is the package level RedeemSMSPincodeContext using the policy.
+func (p Policy) RedeemSMSPincodeContext(ctx context.Context, db *database.DB, phoneNumber, pincode string) (string, error) {
+	var requestID string
+	err := verifyWithAttempts(ctx, db, func(tx *sqlx.Tx) (bool, error) {
+		var commit bool
+		var err error
+		requestID, commit, err = redeemSMSPincode(tx, phoneNumber, pincode, p)
+		return commit, err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return requestID, nil
+}
+
+// RedeemSMSPincodeTx is the package level RedeemSMSPincodeTx using the policy.
+func (p Policy) RedeemSMSPincodeTx(tx *sqlx.Tx, phoneNumber, pincode string) (string, error) {
+	requestID, _, err := redeemSMSPincode(tx, phoneNumber, pincode, p)
+	return requestID, err
+}
+
+// redeemSMSPincode verifies and deletes a pincode, the pincode rows are locked
+// by verifySMSPincode so concurrent redemptions wait for this transaction and
+// no longer find the pincode.
+func redeemSMSPincode(tx *sqlx.Tx, phoneNumber, pincode string, policy Policy) (string, bool, error) {
+	requestID, commit, err := verifySMSPincode(tx, phoneNumber, pincode, policy)
+	if err != nil {
+		return "", commit, err
+	}
+
+	err = DeleteSMSPincodeTx(tx, requestID)
+	if err != nil {
+		return "", false, err
+	}
+
+	return requestID, true, nil
 }
 
 // DeleteSMSPincode removes a pincode record from the database.
 // This function should be used when a pincode has been successfully
-// verified in order to prevent double-booking pincodes.
+// verified in order to prevent double-booking pincodes. Prefer
+// RedeemSMSPincode, as two requests may both verify a pincode before
+// either deletes it.
 func DeleteSMSPincode(db *database.DB, id string) error {
-	queryStr := `DELETE FROM sms_pincodes s WHERE s.id = $1`
-	return db.Update(context.Background(), func(tx *sqlx.Tx) error {
-		_, err := tx.Exec(queryStr, id)
-		return err
+	return DeleteSMSPincodeContext(context.Background(), db, id)
+}
+
+// DeleteSMSPincodeContext is DeleteSMSPincode using the provided context.
+func DeleteSMSPincodeContext(ctx context.Context, db *database.DB, id string) error {
+	return db.Update(ctx, func(tx *sqlx.Tx) error {
+		return DeleteSMSPincodeTx(tx, id)
 	})
 }
+
+// DeleteSMSPincodeTx is DeleteSMSPincode using an existing transaction.
+func DeleteSMSPincodeTx(tx *sqlx.Tx, id string) error {
+	queryStr := `DELETE FROM sms_pincodes s WHERE s.id = $1`
+	_, err := tx.Exec(queryStr, id)
+	return err
+}
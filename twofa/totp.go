@@ -0,0 +1,470 @@
+package twofa
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	qrcode "github.com/skip2/go-qrcode"
+
+	"github.com/cosmotek/api-commons/database"
+)
+
+// TOTPAlgorithm is the HMAC hash function used to generate TOTP codes.
+type TOTPAlgorithm string
+
+const (
+	// TOTPSHA1 is supported by every authenticator app, and is the default.
+	TOTPSHA1   TOTPAlgorithm = "SHA1"
+	TOTPSHA256 TOTPAlgorithm = "SHA256"
+	TOTPSHA512 TOTPAlgorithm = "SHA512"
+)
+
+var (
+	// ErrTOTPNotEnrolled is returned when verifying a code for a subject
+	// which has not enrolled (or not confirmed enrollment) in TOTP.
+	ErrTOTPNotEnrolled = errors.New("user error: totp is not enabled")
+
+	// ErrTOTPAlreadyEnrolled is returned when enrolling a subject which has
+	// already confirmed TOTP enrollment, Disable must be called first.
+	ErrTOTPAlreadyEnrolled = errors.New("user error: totp is already enabled")
+
+	// ErrTOTPCodeInvalid is returned when a TOTP code does not match.
+	ErrTOTPCodeInvalid = errors.New("user error: totp code is invalid")
+
+	// ErrTOTPCodeReused is returned when a TOTP code (or a code from an
+	// earlier time step) has already been used.
+	ErrTOTPCodeReused = errors.New("user error: totp code has already been used")
+)
+
+// TOTPConfig configures TOTP (RFC 6238) code generation and verification.
+type TOTPConfig struct {
+	// Issuer is the name of the service shown by authenticator apps.
+	Issuer string
+
+	// EncryptionKey is the 16, 24 or 32 byte AES key used to encrypt
+	// secrets at rest.
+	EncryptionKey []byte
+
+	// Digits is the length of codes (at most 8), defaults to 6.
+	Digits int
+
+	// Period is the time step of codes, defaults to 30 seconds.
+	Period time.Duration
+
+	// Window is the number of time steps before and after the current
+	// step which are also accepted, to tolerate clock drift. Defaults to 0.
+	Window int
+
+	// Algorithm defaults to TOTPSHA1.
+	Algorithm TOTPAlgorithm
+
+	// Attempts limits failed verification attempts, defaults to
+	// DefaultPolicy.Attempts. Only the lockout settings apply, as TOTP
+	// codes are not issued per request.
+	Attempts AttemptPolicy
+}
+
+// TOTPEnrollment holds the details shown to a user while enrolling an
+// authenticator app. Secret is base32 encoded for manual entry.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// totpSecret is used internally to retrieve TOTP secrets from the database.
+type totpSecret struct {
+	Subject      string     `db:"subject"`
+	Secret       []byte     `db:"secret"`
+	Confirmed    bool       `db:"confirmed"`
+	LastUsedStep int64      `db:"last_used_step"`
+	CreatedAt    time.Time  `db:"created_at"`
+	ConfirmedAt  *time.Time `db:"confirmed_at"`
+}
+
+// TOTP manages authenticator app enrollment and verification, storing
+// encrypted secrets in the totp_secrets table.
+type TOTP struct {
+	db   *database.DB
+	conf TOTPConfig
+	aead cipher.AEAD
+}
+
+// NewTOTP creates a TOTP using the provided database and config.
+func NewTOTP(db *database.DB, conf TOTPConfig) (*TOTP, error) {
+	if conf.Digits <= 0 {
+		conf.Digits = 6
+	}
+
+	if conf.Digits > 8 {
+		return nil, errors.New("totp codes may contain at most 8 digits")
+	}
+
+	if conf.Period < time.Second {
+		conf.Period = time.Second * 30
+	}
+
+	if conf.Algorithm == "" {
+		conf.Algorithm = TOTPSHA1
+	}
+
+	if conf.Attempts == (AttemptPolicy{}) {
+		conf.Attempts = DefaultPolicy.Attempts
+	}
+
+	if _, err := conf.Algorithm.hash(); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(conf.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create totp cipher: %v", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TOTP{
+		db:   db,
+		conf: conf,
+		aead: aead,
+	}, nil
+}
+
+// Enroll generates and stores a new (unconfirmed) secret for subject,
+// returning the secret and otpauth:// provisioning URI to show the user.
+// accountName is the label shown by authenticator apps (e.g. an email).
+// Enrollment must be completed using ConfirmEnrollment.
+func (t *TOTP) Enroll(subject, accountName string) (TOTPEnrollment, error) {
+	return t.EnrollContext(context.Background(), subject, accountName)
+}
+
+// EnrollContext is Enroll using the provided context.
+func (t *TOTP) EnrollContext(ctx context.Context, subject, accountName string) (TOTPEnrollment, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	encrypted, err := t.encrypt(subject, secret)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	err = t.db.Update(ctx, func(tx *sqlx.Tx) error {
+		res, err := tx.Exec(`
+		INSERT INTO totp_secrets (
+			subject,
+			secret,
+			confirmed,
+			last_used_step,
+			created_at
+		) VALUES ($1, $2, FALSE, 0, $3)
+		ON CONFLICT (subject) DO UPDATE SET
+			secret = EXCLUDED.secret,
+			last_used_step = 0,
+			created_at = EXCLUDED.created_at
+		WHERE NOT totp_secrets.confirmed;
+		`, subject, encrypted, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rows == 0 {
+			return ErrTOTPAlreadyEnrolled
+		}
+
+		return nil
+	})
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	encodedSecret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	return TOTPEnrollment{
+		Secret: encodedSecret,
+		URI:    t.provisioningURI(encodedSecret, accountName),
+	}, nil
+}
+
+// ConfirmEnrollment completes enrollment once the user has entered the first
+// code displayed by their authenticator app.
+func (t *TOTP) ConfirmEnrollment(subject, code string) error {
+	return t.ConfirmEnrollmentContext(context.Background(), subject, code)
+}
+
+// ConfirmEnrollmentContext is ConfirmEnrollment using the provided context.
+func (t *TOTP) ConfirmEnrollmentContext(ctx context.Context, subject, code string) error {
+	return t.verify(ctx, subject, code, false)
+}
+
+// Verify checks a code for subject, accepting codes from the configured
+// window of time steps. Each code may only be used once, after a code has
+// been accepted, codes from the same (or an earlier) time step are rejected
+// with ErrTOTPCodeReused. Wrong codes are counted according to
+// TOTPConfig.Attempts, once subject is locked out an *AttemptLimitError
+// is returned.
+func (t *TOTP) Verify(subject, code string) error {
+	return t.VerifyContext(context.Background(), subject, code)
+}
+
+// VerifyContext is Verify using the provided context.
+func (t *TOTP) VerifyContext(ctx context.Context, subject, code string) error {
+	return t.verify(ctx, subject, code, true)
+}
+
+// Enabled reports whether subject has confirmed TOTP enrollment.
+func (t *TOTP) Enabled(subject string) (bool, error) {
+	return t.EnabledContext(context.Background(), subject)
+}
+
+// EnabledContext is Enabled using the provided context.
+func (t *TOTP) EnabledContext(ctx context.Context, subject string) (bool, error) {
+	var confirmed bool
+	err := t.db.View(ctx, func(tx *sqlx.Tx) error {
+		return tx.Get(&confirmed, `SELECT s.confirmed FROM totp_secrets s WHERE s.subject = $1`, subject)
+	})
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return confirmed, err
+}
+
+// Disable removes the TOTP secret of subject.
+func (t *TOTP) Disable(subject string) error {
+	return t.DisableContext(context.Background(), subject)
+}
+
+// DisableContext is Disable using the provided context.
+func (t *TOTP) DisableContext(ctx context.Context, subject string) error {
+	return t.db.Update(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(`DELETE FROM totp_secrets WHERE subject = $1`, subject)
+		return err
+	})
+}
+
+// verify checks code against the secret of subject, confirming enrollment
+// (when confirmed is false) and recording the time step used.
+func (t *TOTP) verify(ctx context.Context, subject, code string, confirmed bool) error {
+	return verifyWithAttempts(ctx, t.db, func(tx *sqlx.Tx) (bool, error) {
+		return t.verifyTx(tx, subject, code, confirmed)
+	})
+}
+
+// verifyTx provides the underlying functionality for verify, reporting
+// whether the transaction should be committed (see verifyWithAttempts).
+func (t *TOTP) verifyTx(tx *sqlx.Tx, subject, code string, confirmed bool) (bool, error) {
+	now := time.Now().UTC()
+	attemptKey := "totp:" + subject
+
+	err := checkAttemptLock(tx, attemptKey, now)
+	if err != nil {
+		_, limited := err.(*AttemptLimitError)
+		return limited, err
+	}
+
+	record := totpSecret{}
+	err = tx.Get(&record, `SELECT * FROM totp_secrets s WHERE s.subject = $1 FOR UPDATE`, subject)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return true, ErrTOTPNotEnrolled
+		}
+
+		return false, err
+	}
+
+	if record.Confirmed != confirmed {
+		if confirmed {
+			return true, ErrTOTPNotEnrolled
+		}
+
+		return true, ErrTOTPAlreadyEnrolled
+	}
+
+	secret, err := t.decrypt(subject, record.Secret)
+	if err != nil {
+		return false, err
+	}
+
+	step, err := t.matchStep(secret, code, now)
+	if err == ErrTOTPCodeInvalid {
+		lockout, err := recordFailedAttempt(tx, attemptKey, t.conf.Attempts, now)
+		if err != nil {
+			return false, err
+		}
+
+		if lockout > 0 {
+			return true, &AttemptLimitError{RetryAfter: lockout}
+		}
+
+		return true, ErrTOTPCodeInvalid
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if step <= record.LastUsedStep {
+		return true, ErrTOTPCodeReused
+	}
+
+	_, err = tx.Exec(`
+	UPDATE totp_secrets SET
+		last_used_step = $2,
+		confirmed = TRUE,
+		confirmed_at = COALESCE(confirmed_at, $3)
+	WHERE subject = $1
+	`, subject, step, now)
+	if err != nil {
+		return false, err
+	}
+
+	err = resetAttempts(tx, attemptKey)
+	return err == nil, err
+}
+
+// matchStep returns the time step (within the configured window of now)
+// at which code is valid.
+func (t *TOTP) matchStep(secret []byte, code string, now time.Time) (int64, error) {
+	if len(code) != t.conf.Digits {
+		return 0, ErrTOTPCodeInvalid
+	}
+
+	current := now.Unix() / int64(t.conf.Period/time.Second)
+	for offset := -t.conf.Window; offset <= t.conf.Window; offset++ {
+		step := current + int64(offset)
+		expected, err := totpCode(secret, step, t.conf.Digits, t.conf.Algorithm)
+		if err != nil {
+			return 0, err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+
+	return 0, ErrTOTPCodeInvalid
+}
+
+// provisioningURI builds the otpauth:// URI used to enroll authenticator apps.
+func (t *TOTP) provisioningURI(encodedSecret, accountName string) string {
+	label := accountName
+	if t.conf.Issuer != "" {
+		label = t.conf.Issuer + ":" + accountName
+	}
+
+	params := url.Values{}
+	params.Set("secret", encodedSecret)
+	params.Set("algorithm", string(t.conf.Algorithm))
+	params.Set("digits", strconv.Itoa(t.conf.Digits))
+	params.Set("period", strconv.Itoa(int(t.conf.Period/time.Second)))
+	if t.conf.Issuer != "" {
+		params.Set("issuer", t.conf.Issuer)
+	}
+
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + label,
+		RawQuery: params.Encode(),
+	}).String()
+}
+
+// encrypt seals a secret using AES-GCM, binding it to subject so that
+// ciphertexts cannot be swapped between records.
+func (t *TOTP) encrypt(subject string, secret []byte) ([]byte, error) {
+	nonce := make([]byte, t.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.aead.Seal(nonce, nonce, secret, []byte(subject)), nil
+}
+
+// decrypt opens a secret sealed by encrypt.
+func (t *TOTP) decrypt(subject string, encrypted []byte) ([]byte, error) {
+	if len(encrypted) < t.aead.NonceSize() {
+		return nil, errors.New("failed to decrypt totp secret, ciphertext too short")
+	}
+
+	nonce, ciphertext := encrypted[:t.aead.NonceSize()], encrypted[t.aead.NonceSize():]
+	secret, err := t.aead.Open(nil, nonce, ciphertext, []byte(subject))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt totp secret: %v", err)
+	}
+
+	return secret, nil
+}
+
+// TOTPQRCode renders a provisioning URI as a QR code PNG of the provided
+// size (in pixels), for scanning with an authenticator app.
+func TOTPQRCode(uri string, size int) ([]byte, error) {
+	return qrcode.Encode(uri, qrcode.Medium, size)
+}
+
+// totpCode generates the RFC 4226 HOTP code for the provided counter
+// (the RFC 6238 time step).
+func totpCode(secret []byte, counter int64, digits int, algorithm TOTPAlgorithm) (string, error) {
+	hashFunc, err := algorithm.hash()
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(hashFunc, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, value%mod), nil
+}
+
+// hash returns the hash function of the algorithm.
+func (a TOTPAlgorithm) hash() (func() hash.Hash, error) {
+	switch a {
+	case TOTPSHA1:
+		return sha1.New, nil
+	case TOTPSHA256:
+		return sha256.New, nil
+	case TOTPSHA512:
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("unsupported totp algorithm '%s'", a)
+	}
+}
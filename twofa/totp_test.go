@@ -0,0 +1,191 @@
+package twofa
+
+import (
+	"bytes"
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	secrets := map[TOTPAlgorithm][]byte{
+		TOTPSHA1:   []byte("12345678901234567890"),
+		TOTPSHA256: []byte("12345678901234567890123456789012"),
+		TOTPSHA512: []byte("1234567890123456789012345678901234567890123456789012345678901234"),
+	}
+
+	scenarios := map[string]struct {
+		Time      int64
+		Algorithm TOTPAlgorithm
+		Code      string
+	}{
+		"sha1 at 59":           {Time: 59, Algorithm: TOTPSHA1, Code: "94287082"},
+		"sha256 at 59":         {Time: 59, Algorithm: TOTPSHA256, Code: "46119246"},
+		"sha512 at 59":         {Time: 59, Algorithm: TOTPSHA512, Code: "90693936"},
+		"sha1 at 1111111109":   {Time: 1111111109, Algorithm: TOTPSHA1, Code: "07081804"},
+		"sha256 at 1111111109": {Time: 1111111109, Algorithm: TOTPSHA256, Code: "68084774"},
+		"sha512 at 1111111109": {Time: 1111111109, Algorithm: TOTPSHA512, Code: "25091201"},
+		"sha1 at 2000000000":   {Time: 2000000000, Algorithm: TOTPSHA1, Code: "69279037"},
+		"sha256 at 2000000000": {Time: 2000000000, Algorithm: TOTPSHA256, Code: "90698825"},
+		"sha512 at 2000000000": {Time: 2000000000, Algorithm: TOTPSHA512, Code: "38618901"},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			code, err := totpCode(secrets[scene.Algorithm], scene.Time/30, 8, scene.Algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if code != scene.Code {
+				t.Errorf("expected code '%s' but got '%s'", scene.Code, code)
+			}
+		})
+	}
+}
+
+func TestTOTPMatchStepWindow(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111109, 0)
+
+	previous, err := totpCode(secret, now.Unix()/30-1, 6, TOTPSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := map[string]struct {
+		Window int
+		Err    error
+	}{
+		"should reject codes outside of the window": {
+			Window: 0,
+			Err:    ErrTOTPCodeInvalid,
+		},
+		"should accept codes within the window": {
+			Window: 1,
+		},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			totp := newTestTOTP(t, TOTPConfig{Window: scene.Window})
+			step, err := totp.matchStep(secret, previous, now)
+			if err != scene.Err {
+				t.Fatalf("expected '%v' but got '%v'", scene.Err, err)
+			}
+
+			if err == nil && step != now.Unix()/30-1 {
+				t.Errorf("expected step %d but got %d", now.Unix()/30-1, step)
+			}
+		})
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	totp := newTestTOTP(t, TOTPConfig{Issuer: "Acme Co"})
+	uri, err := url.Parse(totp.provisioningURI("JBSWY3DPEHPK3PXP", "alice@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Acme Co:alice@example.com" {
+		t.Errorf("unexpected uri '%s'", uri)
+	}
+
+	expected := map[string]string{
+		"secret":    "JBSWY3DPEHPK3PXP",
+		"issuer":    "Acme Co",
+		"algorithm": "SHA1",
+		"digits":    "6",
+		"period":    "30",
+	}
+	for key, value := range expected {
+		if uri.Query().Get(key) != value {
+			t.Errorf("expected %s '%s' but got '%s'", key, value, uri.Query().Get(key))
+		}
+	}
+
+	png, err := TOTPQRCode(uri.String(), 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(png, []byte("\x89PNG")) {
+		t.Error("expected qr code to be a png")
+	}
+}
+
+func TestTOTPSecretEncryption(t *testing.T) {
+	totp := newTestTOTP(t, TOTPConfig{})
+	secret := []byte("12345678901234567890")
+
+	encrypted, err := totp.encrypt("alice", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(encrypted, secret) {
+		t.Error("expected secret to be encrypted")
+	}
+
+	decrypted, err := totp.decrypt("alice", encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(decrypted, secret) {
+		t.Errorf("expected secret '%s' but got '%s'", secret, decrypted)
+	}
+
+	if _, err := totp.decrypt("bob", encrypted); err == nil {
+		t.Error("expected secret bound to another subject to be rejected")
+	}
+}
+
+func newTestTOTP(t *testing.T, conf TOTPConfig) *TOTP {
+	conf.EncryptionKey = bytes.Repeat([]byte{1}, 32)
+	totp, err := NewTOTP(nil, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return totp
+}
+
+func TestTOTPVerifyAttempts(t *testing.T) {
+	db := testDatabase(t)
+	totp, err := NewTOTP(db, TOTPConfig{EncryptionKey: bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject := "totp-" + mustGenerateCode(NumericAlphabet, 8)
+	enrollment, err := totp.Enroll(subject, subject+"@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < DefaultPolicy.Attempts.LockoutThreshold; i++ {
+		err = totp.ConfirmEnrollment(subject, "abcdef")
+	}
+
+	if _, ok := err.(*AttemptLimitError); !ok {
+		t.Fatalf("expected subject to be locked out, got %v", err)
+	}
+
+	code, err := totpCode(secret, time.Now().Unix()/30, 6, TOTPSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = totp.ConfirmEnrollment(subject, code)
+	if _, ok := err.(*AttemptLimitError); !ok {
+		t.Fatalf("expected valid codes to be refused during the lockout, got %v", err)
+	}
+}
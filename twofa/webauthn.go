@@ -0,0 +1,914 @@
+package twofa
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+
+	"github.com/cosmotek/api-commons/database"
+	"github.com/cosmotek/api-commons/token"
+)
+
+// COSE algorithm identifiers supported for WebAuthn credentials.
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// COSE key types and curves of the supported algorithms.
+const (
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+)
+
+// minRSAModulusBits is the smallest RS256 credential modulus accepted.
+const minRSAModulusBits = 2048
+
+// authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+var (
+	// ErrWebAuthnChallengeInvalid is returned when a ceremony references a
+	// challenge which does not exist, has expired or was already used.
+	ErrWebAuthnChallengeInvalid = errors.New("user error: webauthn challenge is invalid or has expired")
+
+	// ErrWebAuthnCredentialInvalid is returned when a ceremony response fails
+	// verification (bad origin, signature, flags or unknown credential).
+	ErrWebAuthnCredentialInvalid = errors.New("user error: webauthn credential is invalid")
+
+	// ErrWebAuthnCloneDetected is returned when the signature counter of a
+	// credential did not increase, indicating the authenticator may have been
+	// cloned. The credential is disabled.
+	ErrWebAuthnCloneDetected = errors.New("user error: webauthn credential disabled, possible cloned authenticator")
+)
+
+// WebAuthnConfig configures the WebAuthn relying party.
+type WebAuthnConfig struct {
+	// RPID is the relying party id, the registrable domain of the
+	// application (e.g. "example.com").
+	RPID string
+
+	// RPName is the name of the application shown by authenticators.
+	RPName string
+
+	// Origins lists the origins ceremonies may be performed from
+	// (e.g. "https://admin.example.com").
+	Origins []string
+
+	// ChallengeTTL is how long a ceremony may take, defaults to 5 minutes.
+	ChallengeTTL time.Duration
+
+	// RequireUserVerification requires authenticators to verify the user
+	// (biometrics or PIN), rather than only their presence.
+	RequireUserVerification bool
+}
+
+// WebAuthnCredential is a registered WebAuthn credential (passkey).
+type WebAuthnCredential struct {
+	ID         string     `json:"id" db:"id"`
+	Subject    string     `json:"subject" db:"subject"`
+	UserHandle []byte     `json:"-" db:"user_handle"`
+	PublicKey  []byte     `json:"-" db:"public_key"`
+	SignCount  int64      `json:"-" db:"sign_count"`
+	AAGUID     []byte     `json:"-" db:"aaguid"`
+	Disabled   bool       `json:"disabled" db:"disabled"`
+	CreatedAt  time.Time  `json:"createdAt" db:"created_at"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty" db:"last_used_at"`
+}
+
+// WebAuthnAssertion is the result of a successful login ceremony.
+type WebAuthnAssertion struct {
+	Email        string
+	CredentialID string
+}
+
+// AuthToken returns the AuthToken for the asserted user, identical to the
+// token issued after magic link verification (see NewEmailAuthToken).
+func (a WebAuthnAssertion) AuthToken(tokenVersion int, role token.Role, audience string, ttl time.Duration) token.AuthToken {
+	return NewEmailAuthToken(a.Email, tokenVersion, role, audience, ttl)
+}
+
+// PublicKeyCredentialDescriptor identifies a credential in ceremony options.
+type PublicKeyCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// CredentialCreationOptions are passed to navigator.credentials.create
+// (after decoding the base64url fields) to register a credential.
+type CredentialCreationOptions struct {
+	ChallengeID string `json:"challengeId"`
+	PublicKey   struct {
+		Challenge string `json:"challenge"`
+		RP        struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"rp"`
+		User struct {
+			ID          string `json:"id"`
+			Name        string `json:"name"`
+			DisplayName string `json:"displayName"`
+		} `json:"user"`
+		PubKeyCredParams []struct {
+			Type string `json:"type"`
+			Alg  int    `json:"alg"`
+		} `json:"pubKeyCredParams"`
+		Timeout                int                             `json:"timeout"`
+		ExcludeCredentials     []PublicKeyCredentialDescriptor `json:"excludeCredentials"`
+		AuthenticatorSelection struct {
+			ResidentKey      string `json:"residentKey"`
+			UserVerification string `json:"userVerification"`
+		} `json:"authenticatorSelection"`
+		Attestation string `json:"attestation"`
+	} `json:"publicKey"`
+}
+
+// CredentialRequestOptions are passed to navigator.credentials.get
+// (after decoding the base64url fields) to log in using a credential.
+type CredentialRequestOptions struct {
+	ChallengeID string `json:"challengeId"`
+	PublicKey   struct {
+		Challenge        string                          `json:"challenge"`
+		RPID             string                          `json:"rpId"`
+		Timeout          int                             `json:"timeout"`
+		AllowCredentials []PublicKeyCredentialDescriptor `json:"allowCredentials"`
+		UserVerification string                          `json:"userVerification"`
+	} `json:"publicKey"`
+}
+
+// RegistrationResponse is the (base64url encoded) PublicKeyCredential
+// returned by navigator.credentials.create.
+type RegistrationResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the (base64url encoded) PublicKeyCredential
+// returned by navigator.credentials.get.
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// webAuthnChallenge is used internally to store ceremony challenges.
+type webAuthnChallenge struct {
+	ID         string    `db:"id"`
+	Subject    string    `db:"subject"`
+	Challenge  []byte    `db:"challenge"`
+	Ceremony   string    `db:"ceremony"`
+	UserHandle []byte    `db:"user_handle"`
+	ExpiresAt  time.Time `db:"expires_at"`
+}
+
+// clientData is the decoded clientDataJSON of a ceremony response.
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// authenticatorData is the decoded authenticator data of a ceremony response.
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// attestationObject is the decoded attestation object of a registration.
+type attestationObject struct {
+	Format   string          `cbor:"fmt"`
+	AttStmt  cbor.RawMessage `cbor:"attStmt"`
+	AuthData []byte          `cbor:"authData"`
+}
+
+// WebAuthn is a WebAuthn relying party, storing credentials and ceremony
+// challenges in the webauthn_credentials and webauthn_challenges tables.
+// Credential subjects are email addresses, so a successful login issues the
+// same AuthToken as magic links. Attestation statements are not verified
+// (attestation "none" is requested), as is usual for passkeys.
+type WebAuthn struct {
+	db   *database.DB
+	conf WebAuthnConfig
+}
+
+// NewWebAuthn creates a WebAuthn relying party using the provided database
+// and config.
+func NewWebAuthn(db *database.DB, conf WebAuthnConfig) (*WebAuthn, error) {
+	if conf.RPID == "" || len(conf.Origins) == 0 {
+		return nil, errors.New("webauthn requires a relying party id and at least one origin")
+	}
+
+	if conf.RPName == "" {
+		conf.RPName = conf.RPID
+	}
+
+	if conf.ChallengeTTL <= 0 {
+		conf.ChallengeTTL = time.Minute * 5
+	}
+
+	return &WebAuthn{
+		db:   db,
+		conf: conf,
+	}, nil
+}
+
+// BeginRegistration starts registering a credential for email, returning the
+// options to pass to navigator.credentials.create. The caller must already
+// have authenticated the user as the owner of email (for example using a
+// magic link), otherwise anyone could add a credential to their account.
+func (w *WebAuthn) BeginRegistration(email, displayName string) (CredentialCreationOptions, error) {
+	return w.BeginRegistrationContext(context.Background(), email, displayName)
+}
+
+// BeginRegistrationContext is BeginRegistration using the provided context.
+func (w *WebAuthn) BeginRegistrationContext(ctx context.Context, email, displayName string) (CredentialCreationOptions, error) {
+	options := CredentialCreationOptions{}
+	err := w.db.Update(ctx, func(tx *sqlx.Tx) error {
+		credentials := []WebAuthnCredential{}
+		err := tx.Select(&credentials, `SELECT * FROM webauthn_credentials c WHERE c.subject = $1`, email)
+		if err != nil {
+			return err
+		}
+
+		// credentials of a user share a handle, so that authenticators
+		// replace (rather than duplicate) their existing passkey
+		var userHandle []byte
+		if len(credentials) > 0 {
+			userHandle = credentials[0].UserHandle
+		} else {
+			userHandle, err = randomBytes(32)
+			if err != nil {
+				return err
+			}
+		}
+
+		challenge, err := w.createChallenge(tx, email, "webauthn.create", userHandle)
+		if err != nil {
+			return err
+		}
+
+		options.ChallengeID = challenge.ID
+		options.PublicKey.Challenge = encodeBase64URL(challenge.Challenge)
+		options.PublicKey.RP.ID = w.conf.RPID
+		options.PublicKey.RP.Name = w.conf.RPName
+		options.PublicKey.User.ID = encodeBase64URL(userHandle)
+		options.PublicKey.User.Name = email
+		options.PublicKey.User.DisplayName = displayName
+		options.PublicKey.Timeout = int(w.conf.ChallengeTTL / time.Millisecond)
+		options.PublicKey.AuthenticatorSelection.ResidentKey = "preferred"
+		options.PublicKey.AuthenticatorSelection.UserVerification = w.userVerification()
+		options.PublicKey.Attestation = "none"
+		for _, alg := range []int{coseAlgES256, coseAlgEdDSA, coseAlgRS256} {
+			options.PublicKey.PubKeyCredParams = append(options.PublicKey.PubKeyCredParams, struct {
+				Type string `json:"type"`
+				Alg  int    `json:"alg"`
+			}{Type: "public-key", Alg: alg})
+		}
+
+		options.PublicKey.ExcludeCredentials = credentialDescriptors(credentials)
+		return nil
+	})
+
+	return options, err
+}
+
+// FinishRegistration verifies the response of navigator.credentials.create
+// and stores the new credential.
+func (w *WebAuthn) FinishRegistration(challengeID string, response RegistrationResponse) (WebAuthnCredential, error) {
+	return w.FinishRegistrationContext(context.Background(), challengeID, response)
+}
+
+// FinishRegistrationContext is FinishRegistration using the provided context.
+func (w *WebAuthn) FinishRegistrationContext(ctx context.Context, challengeID string, response RegistrationResponse) (WebAuthnCredential, error) {
+	challenge, err := w.consumeChallenge(ctx, challengeID, "webauthn.create")
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	credential := WebAuthnCredential{}
+	err = w.db.Update(ctx, func(tx *sqlx.Tx) error {
+		err := w.verifyClientData(response.Response.ClientDataJSON, "webauthn.create", challenge.Challenge)
+		if err != nil {
+			return err
+		}
+
+		rawAttestation, err := decodeBase64URL(response.Response.AttestationObject)
+		if err != nil {
+			return ErrWebAuthnCredentialInvalid
+		}
+
+		attestation := attestationObject{}
+		err = cbor.Unmarshal(rawAttestation, &attestation)
+		if err != nil {
+			return ErrWebAuthnCredentialInvalid
+		}
+
+		authData, err := parseAuthenticatorData(attestation.AuthData)
+		if err != nil {
+			return err
+		}
+
+		err = w.checkAuthenticatorData(authData)
+		if err != nil {
+			return err
+		}
+
+		if authData.Flags&flagAttestedData == 0 {
+			return ErrWebAuthnCredentialInvalid
+		}
+
+		_, _, err = parseCOSEKey(authData.PublicKey)
+		if err != nil {
+			return err
+		}
+
+		credential = WebAuthnCredential{
+			ID:         encodeBase64URL(authData.CredentialID),
+			Subject:    challenge.Subject,
+			UserHandle: challenge.UserHandle,
+			PublicKey:  authData.PublicKey,
+			SignCount:  int64(authData.SignCount),
+			AAGUID:     authData.AAGUID,
+			CreatedAt:  time.Now().UTC(),
+		}
+
+		_, err = tx.NamedExec(`
+		INSERT INTO webauthn_credentials (
+			id,
+			subject,
+			user_handle,
+			public_key,
+			sign_count,
+			aaguid,
+			disabled,
+			created_at
+		) VALUES (
+			:id,
+			:subject,
+			:user_handle,
+			:public_key,
+			:sign_count,
+			:aaguid,
+			:disabled,
+			:created_at
+		);
+		`, credential)
+		return err
+	})
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	return credential, nil
+}
+
+// BeginLogin starts a login ceremony, returning the options to pass to
+// navigator.credentials.get. When email is empty any discoverable credential
+// (passkey) may be used.
+func (w *WebAuthn) BeginLogin(email string) (CredentialRequestOptions, error) {
+	return w.BeginLoginContext(context.Background(), email)
+}
+
+// BeginLoginContext is BeginLogin using the provided context.
+func (w *WebAuthn) BeginLoginContext(ctx context.Context, email string) (CredentialRequestOptions, error) {
+	options := CredentialRequestOptions{}
+	err := w.db.Update(ctx, func(tx *sqlx.Tx) error {
+		credentials := []WebAuthnCredential{}
+		if email != "" {
+			err := tx.Select(&credentials, `SELECT * FROM webauthn_credentials c WHERE c.subject = $1 AND NOT c.disabled`, email)
+			if err != nil {
+				return err
+			}
+		}
+
+		challenge, err := w.createChallenge(tx, email, "webauthn.get", nil)
+		if err != nil {
+			return err
+		}
+
+		options.ChallengeID = challenge.ID
+		options.PublicKey.Challenge = encodeBase64URL(challenge.Challenge)
+		options.PublicKey.RPID = w.conf.RPID
+		options.PublicKey.Timeout = int(w.conf.ChallengeTTL / time.Millisecond)
+		options.PublicKey.AllowCredentials = credentialDescriptors(credentials)
+		options.PublicKey.UserVerification = w.userVerification()
+		return nil
+	})
+
+	return options, err
+}
+
+// FinishLogin verifies the response of navigator.credentials.get, returning
+// the asserted user. ErrWebAuthnCloneDetected is returned (and the credential
+// disabled) if the signature counter did not increase.
+func (w *WebAuthn) FinishLogin(challengeID string, response AssertionResponse) (WebAuthnAssertion, error) {
+	return w.FinishLoginContext(context.Background(), challengeID, response)
+}
+
+// FinishLoginContext is FinishLogin using the provided context.
+func (w *WebAuthn) FinishLoginContext(ctx context.Context, challengeID string, response AssertionResponse) (WebAuthnAssertion, error) {
+	challenge, err := w.consumeChallenge(ctx, challengeID, "webauthn.get")
+	if err != nil {
+		return WebAuthnAssertion{}, err
+	}
+
+	assertion := WebAuthnAssertion{}
+	cloned := false
+	err = w.db.Update(ctx, func(tx *sqlx.Tx) error {
+		credential := WebAuthnCredential{}
+		err := tx.Get(&credential, `SELECT * FROM webauthn_credentials c WHERE c.id = $1 FOR UPDATE`, response.ID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrWebAuthnCredentialInvalid
+			}
+
+			return err
+		}
+
+		err = checkAssertionCredential(response, credential)
+		if err != nil {
+			return err
+		}
+
+		if credential.Disabled || (challenge.Subject != "" && challenge.Subject != credential.Subject) {
+			return ErrWebAuthnCredentialInvalid
+		}
+
+		// the user handle is optional for non-discoverable credentials,
+		// but must belong to the credential when present
+		if response.Response.UserHandle != "" {
+			userHandle, err := decodeBase64URL(response.Response.UserHandle)
+			if err != nil || !bytes.Equal(userHandle, credential.UserHandle) {
+				return ErrWebAuthnCredentialInvalid
+			}
+		}
+
+		err = w.verifyClientData(response.Response.ClientDataJSON, "webauthn.get", challenge.Challenge)
+		if err != nil {
+			return err
+		}
+
+		rawAuthData, err := decodeBase64URL(response.Response.AuthenticatorData)
+		if err != nil {
+			return ErrWebAuthnCredentialInvalid
+		}
+
+		authData, err := parseAuthenticatorData(rawAuthData)
+		if err != nil {
+			return err
+		}
+
+		err = w.checkAuthenticatorData(authData)
+		if err != nil {
+			return err
+		}
+
+		err = verifyAssertionSignature(credential.PublicKey, rawAuthData, response.Response.ClientDataJSON, response.Response.Signature)
+		if err != nil {
+			return err
+		}
+
+		if checkSignCount(credential.SignCount, authData.SignCount) != nil {
+			// the transaction must commit for the credential to be
+			// disabled, so the error is returned once it completes
+			cloned = true
+			_, err = tx.Exec(`UPDATE webauthn_credentials SET disabled = TRUE WHERE id = $1`, credential.ID)
+			return err
+		}
+
+		_, err = tx.Exec(`
+		UPDATE webauthn_credentials SET sign_count = $2, last_used_at = $3 WHERE id = $1
+		`, credential.ID, int64(authData.SignCount), time.Now().UTC())
+		if err != nil {
+			return err
+		}
+
+		assertion = WebAuthnAssertion{
+			Email:        credential.Subject,
+			CredentialID: credential.ID,
+		}
+		return nil
+	})
+	if err != nil {
+		return WebAuthnAssertion{}, err
+	}
+
+	if cloned {
+		return WebAuthnAssertion{}, ErrWebAuthnCloneDetected
+	}
+
+	return assertion, nil
+}
+
+// ListCredentials returns every credential registered for email.
+func (w *WebAuthn) ListCredentials(email string) ([]WebAuthnCredential, error) {
+	return w.ListCredentialsContext(context.Background(), email)
+}
+
+// ListCredentialsContext is ListCredentials using the provided context.
+func (w *WebAuthn) ListCredentialsContext(ctx context.Context, email string) ([]WebAuthnCredential, error) {
+	credentials := []WebAuthnCredential{}
+	err := w.db.View(ctx, func(tx *sqlx.Tx) error {
+		return tx.Select(&credentials, `SELECT * FROM webauthn_credentials c WHERE c.subject = $1 ORDER BY c.created_at`, email)
+	})
+
+	return credentials, err
+}
+
+// RemoveCredential deletes the credential identified by id from email.
+func (w *WebAuthn) RemoveCredential(email, id string) error {
+	return w.RemoveCredentialContext(context.Background(), email, id)
+}
+
+// RemoveCredentialContext is RemoveCredential using the provided context.
+func (w *WebAuthn) RemoveCredentialContext(ctx context.Context, email, id string) error {
+	return w.db.Update(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(`DELETE FROM webauthn_credentials WHERE subject = $1 AND id = $2`, email, id)
+		return err
+	})
+}
+
+// createChallenge stores a random challenge for a ceremony.
+func (w *WebAuthn) createChallenge(tx *sqlx.Tx, subject, ceremony string, userHandle []byte) (webAuthnChallenge, error) {
+	challengeBytes, err := randomBytes(32)
+	if err != nil {
+		return webAuthnChallenge{}, err
+	}
+
+	challenge := webAuthnChallenge{
+		ID:         uuid.New().String(),
+		Subject:    subject,
+		Challenge:  challengeBytes,
+		Ceremony:   ceremony,
+		UserHandle: userHandle,
+		ExpiresAt:  time.Now().UTC().Add(w.conf.ChallengeTTL),
+	}
+
+	_, err = tx.NamedExec(`
+	INSERT INTO webauthn_challenges (
+		id,
+		subject,
+		challenge,
+		ceremony,
+		user_handle,
+		expires_at
+	) VALUES (
+		:id,
+		:subject,
+		:challenge,
+		:ceremony,
+		:user_handle,
+		:expires_at
+	);
+	`, challenge)
+
+	return challenge, err
+}
+
+// consumeChallenge deletes and returns an unexpired challenge, so that
+// each challenge may only be used once. The delete is committed in its own
+// transaction, before the response is verified, so that a failed ceremony
+// cannot be retried with the same challenge.
+func (w *WebAuthn) consumeChallenge(ctx context.Context, id, ceremony string) (webAuthnChallenge, error) {
+	challenge := webAuthnChallenge{}
+	err := w.db.Update(ctx, func(tx *sqlx.Tx) error {
+		return tx.Get(&challenge, `
+		DELETE FROM webauthn_challenges
+		WHERE id = $1 AND ceremony = $2
+		RETURNING *
+		`, id, ceremony)
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return webAuthnChallenge{}, ErrWebAuthnChallengeInvalid
+		}
+
+		return webAuthnChallenge{}, err
+	}
+
+	if challenge.ExpiresAt.Before(time.Now().UTC()) {
+		return webAuthnChallenge{}, ErrWebAuthnChallengeInvalid
+	}
+
+	return challenge, nil
+}
+
+// userVerification returns the userVerification requirement of ceremonies.
+func (w *WebAuthn) userVerification() string {
+	if w.conf.RequireUserVerification {
+		return "required"
+	}
+
+	return "preferred"
+}
+
+// verifyClientData checks the type, challenge and origin of the
+// (base64url encoded) clientDataJSON of a ceremony response.
+func (w *WebAuthn) verifyClientData(encoded, ceremony string, challenge []byte) error {
+	raw, err := decodeBase64URL(encoded)
+	if err != nil {
+		return ErrWebAuthnCredentialInvalid
+	}
+
+	data := clientData{}
+	err = json.Unmarshal(raw, &data)
+	if err != nil {
+		return ErrWebAuthnCredentialInvalid
+	}
+
+	if data.Type != ceremony {
+		return ErrWebAuthnCredentialInvalid
+	}
+
+	responseChallenge, err := decodeBase64URL(data.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(responseChallenge, challenge) != 1 {
+		return ErrWebAuthnChallengeInvalid
+	}
+
+	for _, origin := range w.conf.Origins {
+		if data.Origin == origin {
+			return nil
+		}
+	}
+
+	return ErrWebAuthnCredentialInvalid
+}
+
+// checkAuthenticatorData checks the relying party id hash and the user
+// presence (and verification) flags of authenticator data.
+func (w *WebAuthn) checkAuthenticatorData(authData authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(w.conf.RPID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return ErrWebAuthnCredentialInvalid
+	}
+
+	if authData.Flags&flagUserPresent == 0 {
+		return ErrWebAuthnCredentialInvalid
+	}
+
+	if w.conf.RequireUserVerification && authData.Flags&flagUserVerified == 0 {
+		return ErrWebAuthnCredentialInvalid
+	}
+
+	return nil
+}
+
+// parseAuthenticatorData decodes authenticator data, including the attested
+// credential data when present.
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	if len(data) < 37 {
+		return authenticatorData{}, ErrWebAuthnCredentialInvalid
+	}
+
+	authData := authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	if authData.Flags&flagAttestedData == 0 {
+		return authData, nil
+	}
+
+	rest := data[37:]
+	if len(rest) < 18 {
+		return authenticatorData{}, ErrWebAuthnCredentialInvalid
+	}
+
+	authData.AAGUID = rest[:16]
+	credentialIDLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < credentialIDLength {
+		return authenticatorData{}, ErrWebAuthnCredentialInvalid
+	}
+
+	authData.CredentialID = rest[:credentialIDLength]
+
+	// the public key is followed by optional extensions, so only
+	// the first cbor item is read
+	var publicKey cbor.RawMessage
+	err := cbor.NewDecoder(bytes.NewReader(rest[credentialIDLength:])).Decode(&publicKey)
+	if err != nil {
+		return authenticatorData{}, ErrWebAuthnCredentialInvalid
+	}
+
+	authData.PublicKey = publicKey
+	return authData, nil
+}
+
+// parseCOSEKey decodes a COSE_Key encoded credential public key, returning
+// the key and its COSE algorithm.
+func parseCOSEKey(data []byte) (crypto.PublicKey, int, error) {
+	key := map[int]interface{}{}
+	err := cbor.Unmarshal(data, &key)
+	if err != nil {
+		return nil, 0, ErrWebAuthnCredentialInvalid
+	}
+
+	kty, ktyOK := coseInt(key[1])
+	alg, algOK := coseInt(key[3])
+	if !ktyOK || !algOK {
+		return nil, 0, ErrWebAuthnCredentialInvalid
+	}
+
+	// the curve shares label -1 with the RSA modulus
+	crv, _ := coseInt(key[-1])
+
+	switch alg {
+	case coseAlgES256:
+		if kty != coseKtyEC2 || crv != coseCrvP256 {
+			return nil, 0, ErrWebAuthnCredentialInvalid
+		}
+
+		x, xOK := key[-2].([]byte)
+		y, yOK := key[-3].([]byte)
+		if !xOK || !yOK {
+			return nil, 0, ErrWebAuthnCredentialInvalid
+		}
+
+		publicKey := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, 0, ErrWebAuthnCredentialInvalid
+		}
+
+		return publicKey, alg, nil
+	case coseAlgEdDSA:
+		if kty != coseKtyOKP || crv != coseCrvEd25519 {
+			return nil, 0, ErrWebAuthnCredentialInvalid
+		}
+
+		x, ok := key[-2].([]byte)
+		if !ok || len(x) != ed25519.PublicKeySize {
+			return nil, 0, ErrWebAuthnCredentialInvalid
+		}
+
+		return ed25519.PublicKey(x), alg, nil
+	case coseAlgRS256:
+		n, nOK := key[-1].([]byte)
+		e, eOK := key[-2].([]byte)
+		if kty != coseKtyRSA || !nOK || !eOK || len(e) == 0 || len(e) > 4 {
+			return nil, 0, ErrWebAuthnCredentialInvalid
+		}
+
+		publicKey := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if publicKey.N.BitLen() < minRSAModulusBits {
+			return nil, 0, ErrWebAuthnCredentialInvalid
+		}
+
+		return publicKey, alg, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported webauthn algorithm %d", alg)
+	}
+}
+
+// verifyAssertionSignature verifies the signature of an assertion over the
+// authenticator data and the hash of the (base64url encoded) clientDataJSON.
+func verifyAssertionSignature(coseKey, authData []byte, encodedClientData, encodedSignature string) error {
+	publicKey, alg, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+
+	rawClientData, err := decodeBase64URL(encodedClientData)
+	if err != nil {
+		return ErrWebAuthnCredentialInvalid
+	}
+
+	signature, err := decodeBase64URL(encodedSignature)
+	if err != nil {
+		return ErrWebAuthnCredentialInvalid
+	}
+
+	clientDataHash := sha256.Sum256(rawClientData)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+
+	valid := false
+	switch alg {
+	case coseAlgES256:
+		digest := sha256.Sum256(signed)
+		valid = ecdsa.VerifyASN1(publicKey.(*ecdsa.PublicKey), digest[:], signature)
+	case coseAlgEdDSA:
+		valid = ed25519.Verify(publicKey.(ed25519.PublicKey), signed, signature)
+	case coseAlgRS256:
+		digest := sha256.Sum256(signed)
+		valid = rsa.VerifyPKCS1v15(publicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	}
+
+	if !valid {
+		return ErrWebAuthnCredentialInvalid
+	}
+
+	return nil
+}
+
+// checkAssertionCredential returns ErrWebAuthnCredentialInvalid unless the
+// assertion is a public key credential response for the stored credential.
+func checkAssertionCredential(response AssertionResponse, credential WebAuthnCredential) error {
+	if response.Type != "public-key" || response.ID != credential.ID {
+		return ErrWebAuthnCredentialInvalid
+	}
+
+	return nil
+}
+
+// checkSignCount returns ErrWebAuthnCloneDetected if the signature counter
+// did not increase. Authenticators which do not implement a counter always
+// report zero.
+func checkSignCount(stored int64, received uint32) error {
+	if (stored != 0 || received != 0) && int64(received) <= stored {
+		return ErrWebAuthnCloneDetected
+	}
+
+	return nil
+}
+
+// coseInt converts a decoded cbor integer to an int.
+func coseInt(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case int64:
+		return int(v), true
+	case uint64:
+		return int(v), true
+	default:
+		return 0, false
+	}
+}
+
+// credentialDescriptors lists the credentials as ceremony descriptors.
+func credentialDescriptors(credentials []WebAuthnCredential) []PublicKeyCredentialDescriptor {
+	descriptors := make([]PublicKeyCredentialDescriptor, 0, len(credentials))
+	for _, credential := range credentials {
+		descriptors = append(descriptors, PublicKeyCredentialDescriptor{
+			Type: "public-key",
+			ID:   credential.ID,
+		})
+	}
+
+	return descriptors
+}
+
+// randomBytes returns length bytes read from crypto/rand.
+func randomBytes(length int) ([]byte, error) {
+	buff := make([]byte, length)
+	_, err := rand.Read(buff)
+	return buff, err
+}
+
+// encodeBase64URL encodes data as unpadded base64url, as used by WebAuthn.
+func encodeBase64URL(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeBase64URL decodes base64url, tolerating padding.
+func decodeBase64URL(data string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "="))
+}
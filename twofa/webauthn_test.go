@@ -0,0 +1,375 @@
+package twofa
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/cosmotek/api-commons/token"
+)
+
+// fakeAuthenticator is a software ES256 authenticator used to produce
+// ceremony responses.
+type fakeAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+}
+
+func newFakeAuthenticator(t *testing.T) fakeAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fakeAuthenticator{key: key, credentialID: []byte("credential-1")}
+}
+
+func (a fakeAuthenticator) coseKey(t *testing.T) []byte {
+	coseKey, err := cbor.Marshal(map[int]interface{}{
+		1:  2,
+		3:  coseAlgES256,
+		-1: 1,
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return coseKey
+}
+
+func (a fakeAuthenticator) authData(t *testing.T, rpID string, flags byte, signCount uint32, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	if attested {
+		flags |= flagAttestedData
+	}
+
+	data = append(data, flags)
+	counter := make([]byte, 4)
+	binary.BigEndian.PutUint32(counter, signCount)
+	data = append(data, counter...)
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = append(data, byte(len(a.credentialID)>>8), byte(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey(t)...)
+	}
+
+	return data
+}
+
+func (a fakeAuthenticator) sign(t *testing.T, authData, clientDataJSON []byte) []byte {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signature
+}
+
+func clientDataJSON(t *testing.T, ceremony string, challenge []byte, origin string) []byte {
+	data, err := json.Marshal(clientData{
+		Type:      ceremony,
+		Challenge: encodeBase64URL(challenge),
+		Origin:    origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func testWebAuthn(requireUV bool) *WebAuthn {
+	w, _ := NewWebAuthn(nil, WebAuthnConfig{
+		RPID:                    "example.com",
+		Origins:                 []string{"https://admin.example.com"},
+		RequireUserVerification: requireUV,
+	})
+	return w
+}
+
+func TestParseAuthenticatorDataAttested(t *testing.T) {
+	authenticator := newFakeAuthenticator(t)
+	data := authenticator.authData(t, "example.com", flagUserPresent, 7, true)
+
+	// trailing extensions must not be read as part of the public key
+	data = append(data, 0xa0)
+
+	authData, err := parseAuthenticatorData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if authData.SignCount != 7 || string(authData.CredentialID) != "credential-1" {
+		t.Fatalf("unexpected authenticator data %+v", authData)
+	}
+
+	publicKey, alg, err := parseCOSEKey(authData.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if alg != coseAlgES256 || !publicKey.(*ecdsa.PublicKey).Equal(&authenticator.key.PublicKey) {
+		t.Fatal("expected the authenticator public key")
+	}
+}
+
+func TestParseAuthenticatorDataTruncated(t *testing.T) {
+	authenticator := newFakeAuthenticator(t)
+	data := authenticator.authData(t, "example.com", flagUserPresent, 0, true)
+
+	for _, length := range []int{0, 36, 40, 60} {
+		_, err := parseAuthenticatorData(data[:length])
+		if err != ErrWebAuthnCredentialInvalid {
+			t.Fatalf("expected ErrWebAuthnCredentialInvalid for length %d, got %v", length, err)
+		}
+	}
+}
+
+func TestVerifyClientData(t *testing.T) {
+	challenge := []byte("0123456789abcdef0123456789abcdef")
+
+	scenarios := map[string]struct {
+		Ceremony  string
+		Challenge []byte
+		Origin    string
+		Error     error
+	}{
+		"valid":           {Ceremony: "webauthn.get", Challenge: challenge, Origin: "https://admin.example.com"},
+		"wrong type":      {Ceremony: "webauthn.create", Challenge: challenge, Origin: "https://admin.example.com", Error: ErrWebAuthnCredentialInvalid},
+		"wrong origin":    {Ceremony: "webauthn.get", Challenge: challenge, Origin: "https://evil.example.com", Error: ErrWebAuthnCredentialInvalid},
+		"wrong challenge": {Ceremony: "webauthn.get", Challenge: []byte("other"), Origin: "https://admin.example.com", Error: ErrWebAuthnChallengeInvalid},
+	}
+
+	w := testWebAuthn(false)
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			data := clientDataJSON(t, scene.Ceremony, scene.Challenge, scene.Origin)
+			err := w.verifyClientData(encodeBase64URL(data), "webauthn.get", challenge)
+			if err != scene.Error {
+				t.Fatalf("expected %v, got %v", scene.Error, err)
+			}
+		})
+	}
+}
+
+func TestCheckAuthenticatorData(t *testing.T) {
+	authenticator := newFakeAuthenticator(t)
+
+	scenarios := map[string]struct {
+		RPID      string
+		Flags     byte
+		RequireUV bool
+		Valid     bool
+	}{
+		"user present":               {RPID: "example.com", Flags: flagUserPresent, Valid: true},
+		"user verified":              {RPID: "example.com", Flags: flagUserPresent | flagUserVerified, RequireUV: true, Valid: true},
+		"user not present":           {RPID: "example.com", Flags: 0},
+		"user verification required": {RPID: "example.com", Flags: flagUserPresent, RequireUV: true},
+		"wrong relying party":        {RPID: "evil.com", Flags: flagUserPresent},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			authData, err := parseAuthenticatorData(authenticator.authData(t, scene.RPID, scene.Flags, 1, false))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = testWebAuthn(scene.RequireUV).checkAuthenticatorData(authData)
+			if (err == nil) != scene.Valid {
+				t.Fatalf("expected valid %v, got %v", scene.Valid, err)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertionSignature(t *testing.T) {
+	authenticator := newFakeAuthenticator(t)
+	authData := authenticator.authData(t, "example.com", flagUserPresent, 2, false)
+	data := clientDataJSON(t, "webauthn.get", []byte("challenge"), "https://admin.example.com")
+	signature := authenticator.sign(t, authData, data)
+
+	err := verifyAssertionSignature(authenticator.coseKey(t), authData, encodeBase64URL(data), encodeBase64URL(signature))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, authData...)
+	tampered[len(tampered)-1]++
+	err = verifyAssertionSignature(authenticator.coseKey(t), tampered, encodeBase64URL(data), encodeBase64URL(signature))
+	if err != ErrWebAuthnCredentialInvalid {
+		t.Fatalf("expected ErrWebAuthnCredentialInvalid for tampered data, got %v", err)
+	}
+
+	other := newFakeAuthenticator(t)
+	err = verifyAssertionSignature(other.coseKey(t), authData, encodeBase64URL(data), encodeBase64URL(signature))
+	if err != ErrWebAuthnCredentialInvalid {
+		t.Fatalf("expected ErrWebAuthnCredentialInvalid for other key, got %v", err)
+	}
+}
+
+func TestCheckSignCount(t *testing.T) {
+	scenarios := map[string]struct {
+		Stored   int64
+		Received uint32
+		Error    error
+	}{
+		"no counter":    {Stored: 0, Received: 0},
+		"first use":     {Stored: 0, Received: 1},
+		"increased":     {Stored: 5, Received: 6},
+		"same counter":  {Stored: 5, Received: 5, Error: ErrWebAuthnCloneDetected},
+		"lower counter": {Stored: 5, Received: 3, Error: ErrWebAuthnCloneDetected},
+		"counter reset": {Stored: 5, Received: 0, Error: ErrWebAuthnCloneDetected},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			err := checkSignCount(scene.Stored, scene.Received)
+			if err != scene.Error {
+				t.Fatalf("expected %v, got %v", scene.Error, err)
+			}
+		})
+	}
+}
+
+func TestWebAuthnAssertionAuthToken(t *testing.T) {
+	authToken := WebAuthnAssertion{Email: "admin@example.com"}.AuthToken(0, token.AdminUser, "dashboard", time.Hour)
+	if authToken.Subject != "admin@example.com" || authToken.SubjectType != token.Email || authToken.ID == "" {
+		t.Fatalf("unexpected auth token %+v", authToken)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := token.NewSigningKey("kid", rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenStr, err := key.Sign(authToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verified, err := key.Verify(tokenStr)
+	if err != nil {
+		t.Fatalf("expected the signed token to verify, got %v", err)
+	}
+
+	if verified.Subject != authToken.Subject || verified.TokenVersion != 1 {
+		t.Fatalf("unexpected verified token %+v", verified)
+	}
+}
+
+func TestParseCOSEKeyES256(t *testing.T) {
+	authenticator := newFakeAuthenticator(t)
+	x := authenticator.key.X.FillBytes(make([]byte, 32))
+	y := authenticator.key.Y.FillBytes(make([]byte, 32))
+
+	scenarios := map[string]struct {
+		Key   map[int]interface{}
+		Error error
+	}{
+		"should accept a P-256 key": {
+			Key: map[int]interface{}{1: coseKtyEC2, 3: coseAlgES256, -1: coseCrvP256, -2: x, -3: y},
+		},
+		"should reject the wrong curve": {
+			Key:   map[int]interface{}{1: coseKtyEC2, 3: coseAlgES256, -1: 2, -2: x, -3: y},
+			Error: ErrWebAuthnCredentialInvalid,
+		},
+		"should reject a missing curve": {
+			Key:   map[int]interface{}{1: coseKtyEC2, 3: coseAlgES256, -2: x, -3: y},
+			Error: ErrWebAuthnCredentialInvalid,
+		},
+		"should reject the wrong key type": {
+			Key:   map[int]interface{}{1: coseKtyOKP, 3: coseAlgES256, -1: coseCrvP256, -2: x, -3: y},
+			Error: ErrWebAuthnCredentialInvalid,
+		},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			data, err := cbor.Marshal(scene.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err = parseCOSEKey(data)
+			if err != scene.Error {
+				t.Fatalf("expected %v, got %v", scene.Error, err)
+			}
+		})
+	}
+}
+
+func TestParseCOSEKeyRS256(t *testing.T) {
+	e := []byte{1, 0, 1}
+
+	scenarios := map[string]struct {
+		Bits  int
+		Error error
+	}{
+		"should accept a 2048 bit modulus": {Bits: 2048},
+		"should reject a 1024 bit modulus": {Bits: 1024, Error: ErrWebAuthnCredentialInvalid},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			key, err := rsa.GenerateKey(rand.Reader, scene.Bits)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := cbor.Marshal(map[int]interface{}{1: coseKtyRSA, 3: coseAlgRS256, -1: key.N.Bytes(), -2: e})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err = parseCOSEKey(data)
+			if err != scene.Error {
+				t.Fatalf("expected %v, got %v", scene.Error, err)
+			}
+		})
+	}
+}
+
+func TestCheckAssertionCredential(t *testing.T) {
+	credential := WebAuthnCredential{ID: "credential"}
+
+	scenarios := map[string]struct {
+		ID    string
+		Type  string
+		Error error
+	}{
+		"should accept the stored credential":  {ID: "credential", Type: "public-key"},
+		"should reject another credential":     {ID: "other", Type: "public-key", Error: ErrWebAuthnCredentialInvalid},
+		"should reject other credential types": {ID: "credential", Type: "password", Error: ErrWebAuthnCredentialInvalid},
+		"should reject a missing type":         {ID: "credential", Error: ErrWebAuthnCredentialInvalid},
+	}
+
+	for name, scene := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			response := AssertionResponse{ID: scene.ID, Type: scene.Type}
+			err := checkAssertionCredential(response, credential)
+			if err != scene.Error {
+				t.Fatalf("expected %v, got %v", scene.Error, err)
+			}
+		})
+	}
+}